@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// formatAlert formats alert in the line format of the alert direction:
+// MEASUREMENT,deviceType=,deviceId=,direction=alert,etc= data=,trigger=,triggerAt=,triggerType=,actionSensor=,currentValue= timestamp
+func formatAlert(measurement string, deviceType string, deviceId string, etc string, alert Alert) string {
+	var sb strings.Builder
+
+	var trigger string
+	var triggerAt string
+	var triggerType string
+	var actionSensor string
+
+	if alert.Trigger != "" {
+		trigger = alert.Trigger
+	} else {
+		trigger = "empty"
+	}
+
+	if alert.TriggerAt != "" {
+		triggerAt = alert.TriggerAt
+	} else {
+		triggerAt = "empty"
+	}
+
+	if alert.TriggerType != "" {
+		triggerType = alert.TriggerType
+	} else {
+		triggerType = "empty"
+	}
+
+	if alert.ActionSensor != "" {
+		actionSensor = alert.ActionSensor
+	} else {
+		actionSensor = "empty"
+	}
+
+	sb.WriteString(measurement)
+
+	// Tags
+	sb.WriteString(`,deviceType=`)
+	sb.WriteString(deviceType)
+	sb.WriteString(`,deviceId=`)
+	sb.WriteString(deviceId)
+	// sb.WriteString(`,type=alert`)
+	sb.WriteString(`,direction=`)
+	sb.WriteString("alert")
+	sb.WriteString(`,etc=`)
+	sb.WriteString(etc)
+
+	// unixTimestamp := alert.LastPlayed.UnixNano()
+	// Fields
+	sb.WriteString(` `)
+	sb.WriteString(`data="`)
+	sb.WriteString(alert.Data)
+	sb.WriteString(`",trigger="`)
+	sb.WriteString(trigger)
+	sb.WriteString(`",triggerAt="`)
+	sb.WriteString(triggerAt)
+	sb.WriteString(`",triggerType="`)
+	sb.WriteString(triggerType)
+	sb.WriteString(`"`)
+	// sb.WriteString(`",lastPlayed=`)
+	// sb.WriteString(alert.LastPlayed)
+	sb.WriteString(`,actionSensor="`)
+	sb.WriteString(actionSensor)
+	sb.WriteString(`",currentValue="`)
+	sb.WriteString(alert.CurrentValue)
+	sb.WriteString(`"`)
+
+	// Timestamp_ms
+	sb.WriteString(` `)
+	sb.WriteString(strconv.FormatInt(int64(alert.Timestamp), 10))
+
+	return sb.String()
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BatteryProfile tells which field of a measurement holds the battery voltage and how to turn it
+// into a state of charge, e.g.
+// {"measurement": "SmartLight", "field": "boardVoltage", "chemistry": "li-socl2", "low_percent": 20}
+// A measurement with several batteries has a profile for each, with distinct outputs.
+type BatteryProfile struct {
+	Measurement string  `json:"measurement"`
+	Field       string  `json:"field"`
+	Chemistry   string  `json:"chemistry"`   // key of the battery curves, the device battery_chemistry overrides it
+	Scale       float64 `json:"scale"`       // multiplies the field to get volts, e.g. 0.001 for mV, 1 when unset
+	LowPercent  float64 `json:"low_percent"` // low battery alert threshold, 20 when unset
+	Output      string  `json:"output"`      // prefix of the written fields, {output}Percent and {output}DaysRemaining, "battery" when unset
+}
+
+// BatteryCurve maps a voltage to a state of charge with [voltage, percent] points sorted by voltage.
+type BatteryCurve [][2]float64
+
+// defaultBatteryCurves are used for the chemistries missing in battery_curves of the schema.
+var defaultBatteryCurves = map[string]BatteryCurve{
+	"li-socl2":     {{3.0, 0}, {3.2, 5}, {3.3, 10}, {3.4, 25}, {3.5, 60}, {3.6, 100}},
+	"liion":        {{3.0, 0}, {3.3, 5}, {3.5, 10}, {3.6, 20}, {3.7, 40}, {3.8, 60}, {3.9, 75}, {4.0, 85}, {4.1, 95}, {4.2, 100}},
+	"lifepo4":      {{2.5, 0}, {3.0, 10}, {3.2, 30}, {3.25, 50}, {3.3, 70}, {3.35, 90}, {3.4, 100}},
+	"alkaline-2aa": {{2.0, 0}, {2.2, 10}, {2.4, 30}, {2.6, 60}, {2.8, 85}, {3.0, 100}},
+	"percent":      {{0, 0}, {100, 100}},
+}
+
+// defaultBatteryProfiles are used when the schema has no battery_profiles.
+var defaultBatteryProfiles = []BatteryProfile{
+	{Measurement: "SmartLight", Field: "boardVoltage", Chemistry: "li-socl2"},
+	{Measurement: "SmartLight", Field: "batteryVoltage", Chemistry: "liion", Scale: 0.001, Output: "boxBattery"},
+	{Measurement: "WaterTankLevel", Field: "boardVoltage", Chemistry: "li-socl2"},
+	{Measurement: "GaugePressure", Field: "boardVoltage", Chemistry: "li-socl2"},
+	{Measurement: "Hydrometer", Field: "boardVoltage", Chemistry: "li-socl2"},
+	{Measurement: "EnergyMeter", Field: "boardVoltage", Chemistry: "li-socl2"},
+	{Measurement: "Sprinkler", Field: "boardVoltage", Chemistry: "li-socl2"},
+	{Measurement: "SoilMoisture3DepthLevels", Field: "boardVoltage", Chemistry: "li-socl2"},
+	{Measurement: "Temperature8Point", Field: "boardVoltage", Chemistry: "li-socl2"},
+	{Measurement: "VibrationAverage", Field: "boardVoltage", Chemistry: "li-socl2"},
+	{Measurement: "WeatherStation", Field: "internalBatteryVoltage", Chemistry: "li-socl2"},
+	{Measurement: "Status", Field: "porcentagem_bat", Chemistry: "percent"},
+}
+
+type BatterySample struct {
+	Timestamp int64
+	Percent   float64
+}
+
+type BatteryState struct {
+	Samples []BatterySample
+	Low     bool
+}
+
+// batteryStates is keyed by deviceId/field and only touched from the main loop goroutine.
+var batteryStates = make(map[string]*BatteryState)
+
+var (
+	// Samples older than batteryTrendWindow are left out of the discharge trend
+	batteryTrendWindow = 7 * 24 * time.Hour
+	// A sample is kept for the trend at most every batterySampleInterval
+	batterySampleInterval = time.Hour
+)
+
+// estimateBattery adds batteryPercent and, once the discharge trend is known, batteryDaysRemaining
+// to a parsed message for every battery profile of its measurement, and emits a low battery alert
+// when the charge drops below the profile limit.
+func estimateBattery(message string, deviceType string, deviceId string, now time.Time) string {
+	line, ok := parseLine(message)
+	if !ok {
+		return message
+	}
+	if id, ok := line.Tags["deviceId"]; ok && id != "" {
+		deviceId = id
+	}
+
+	var sb strings.Builder
+	for _, profile := range batteryProfiles(line.Measurement) {
+		sb.WriteString(estimateBatteryProfile(line, profile, deviceType, deviceId, now))
+	}
+	if sb.Len() == 0 {
+		return message
+	}
+	return appendFields(message, sb.String())
+}
+
+// estimateBatteryProfile returns the fields of one battery profile, "" when line does not carry
+// its voltage.
+func estimateBatteryProfile(line Line, profile BatteryProfile, deviceType string, deviceId string, now time.Time) string {
+	value, ok := fieldFloat(line.Fields[profile.Field])
+	if !ok {
+		return ""
+	}
+
+	chemistry := profile.Chemistry
+	if device := lookupDevice(deviceId, line.Measurement, deviceType); device != nil && device.BatteryChemistry != "" {
+		chemistry = device.BatteryChemistry
+	}
+	curve, ok := schema.BatteryCurves[chemistry]
+	if !ok {
+		curve, ok = defaultBatteryCurves[chemistry]
+	}
+	if !ok {
+		fmt.Printf("\nUnknown battery chemistry %s for %s", chemistry, deviceId)
+		return ""
+	}
+
+	scale := profile.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	percent := roundFloat(curve.percent(value*scale), 1)
+
+	timestamp := line.Timestamp
+	if timestamp == 0 {
+		timestamp = now.UnixNano()
+	}
+
+	key := deviceId + "/" + profile.Field
+	state, ok := batteryStates[key]
+	if !ok {
+		state = &BatteryState{}
+		batteryStates[key] = state
+	}
+	if n := len(state.Samples); n == 0 || time.Duration(timestamp-state.Samples[n-1].Timestamp) >= batterySampleInterval {
+		state.Samples = append(state.Samples, BatterySample{Timestamp: timestamp, Percent: percent})
+	}
+	for len(state.Samples) > 0 && time.Duration(timestamp-state.Samples[0].Timestamp) > batteryTrendWindow {
+		state.Samples = state.Samples[1:]
+	}
+
+	output := profile.Output
+	if output == "" {
+		output = "battery"
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`,`)
+	sb.WriteString(output)
+	sb.WriteString(`Percent=`)
+	sb.WriteString(strconv.FormatFloat(percent, 'f', -1, 64))
+	if days, ok := state.daysRemaining(percent); ok {
+		sb.WriteString(`,`)
+		sb.WriteString(output)
+		sb.WriteString(`DaysRemaining=`)
+		sb.WriteString(strconv.FormatFloat(roundFloat(days, 1), 'f', -1, 64))
+	}
+
+	lowPercent := profile.LowPercent
+	if lowPercent == 0 {
+		lowPercent = 20
+	}
+	switch {
+	case !state.Low && percent < lowPercent:
+		state.Low = true
+
+		var alert Alert
+		alert.DeviceId = deviceId
+		alert.DeviceType = deviceType
+		alert.Etc = "gateway"
+		alert.Data = chemistry + " battery at " + strconv.FormatFloat(value, 'f', -1, 64)
+		alert.Timestamp = timestamp
+		alert.Trigger = output + "Percent < " + strconv.FormatFloat(lowPercent, 'f', -1, 64)
+		alert.TriggerAt = now.Format(time.RFC3339)
+		alert.TriggerType = "battery"
+		alert.ActionSensor = profile.Field
+		alert.CurrentValue = strconv.FormatFloat(percent, 'f', -1, 64)
+		emitRecord(formatAlert(line.Measurement, deviceType, deviceId, alert.Etc, alert))
+
+	// Re-armed once the battery is replaced or recharged
+	case state.Low && percent >= lowPercent+10:
+		state.Low = false
+	}
+
+	return sb.String()
+}
+
+// batteryProfiles returns the profiles of a measurement, from the schema or else the defaults.
+func batteryProfiles(measurement string) []BatteryProfile {
+	profiles := schema.BatteryProfiles
+	if len(profiles) == 0 {
+		profiles = defaultBatteryProfiles
+	}
+	var matching []BatteryProfile
+	for _, profile := range profiles {
+		if profile.Measurement == measurement {
+			matching = append(matching, profile)
+		}
+	}
+	return matching
+}
+
+// percent interpolates the state of charge of a voltage linearly between the curve points.
+func (c BatteryCurve) percent(voltage float64) float64 {
+	if len(c) == 0 {
+		return 0
+	}
+	i := sort.Search(len(c), func(i int) bool { return c[i][0] >= voltage })
+	switch {
+	case i == 0:
+		return c[0][1]
+	case i == len(c):
+		return c[len(c)-1][1]
+	}
+	v0, p0 := c[i-1][0], c[i-1][1]
+	v1, p1 := c[i][0], c[i][1]
+	return p0 + (voltage-v0)/(v1-v0)*(p1-p0)
+}
+
+// daysRemaining extrapolates the least squares discharge rate of the samples to 0%. It needs at
+// least a day of samples and a discharging battery.
+func (s *BatteryState) daysRemaining(percent float64) (float64, bool) {
+	n := len(s.Samples)
+	if n < 3 || time.Duration(s.Samples[n-1].Timestamp-s.Samples[0].Timestamp) < 24*time.Hour {
+		return 0, false
+	}
+
+	var sumX, sumY, sumXY, sumXX float64
+	for _, sample := range s.Samples {
+		x := float64(sample.Timestamp-s.Samples[0].Timestamp) / float64(24*time.Hour)
+		sumX += x
+		sumY += sample.Percent
+		sumXY += x * sample.Percent
+		sumXX += x * x
+	}
+	denominator := float64(n)*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, false
+	}
+	slope := (float64(n)*sumXY - sumX*sumY) / denominator // percent per day
+	if slope >= 0 {
+		return 0, false
+	}
+	return percent / -slope, true
+}
+
+func validateBatteryCurves(curves map[string]BatteryCurve) error {
+	for chemistry, curve := range curves {
+		for i := 1; i < len(curve); i++ {
+			if curve[i][0] <= curve[i-1][0] {
+				return fmt.Errorf("battery curve %q must be sorted by voltage", chemistry)
+			}
+		}
+	}
+	return nil
+}
+
+// validateBatteryProfiles checks that the profiles of a measurement write distinct fields.
+func validateBatteryProfiles(profiles []BatteryProfile) error {
+	outputs := make(map[string]bool)
+	for _, profile := range profiles {
+		if profile.Measurement == "" || profile.Field == "" {
+			return fmt.Errorf("battery profile needs a measurement and a field")
+		}
+		if profile.Scale < 0 {
+			return fmt.Errorf("battery profile %s.%s: scale must not be negative", profile.Measurement, profile.Field)
+		}
+		output := profile.Output
+		if output == "" {
+			output = "battery"
+		}
+		if outputs[profile.Measurement+"/"+output] {
+			return fmt.Errorf("battery profiles of %s need distinct outputs, %q is repeated", profile.Measurement, output)
+		}
+		outputs[profile.Measurement+"/"+output] = true
+	}
+	return nil
+}
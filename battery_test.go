@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEstimateBatteryProfiles(t *testing.T) {
+	t.Cleanup(func() {
+		batteryStates = make(map[string]*BatteryState)
+		pendingRecords = pendingRecords[:0]
+	})
+
+	// boardVoltage in V on li-socl2, batteryVoltage in mV on liion
+	message := "SmartLight,deviceId=0004a30b00000001,deviceType=SmartLight boardVoltage=3.55,batteryVoltage=3800 1700000000000000000"
+	got := estimateBattery(message, "SmartLight", "0004a30b00000001", time.Unix(1700000000, 0))
+
+	want := message[:strings.LastIndex(message, " ")] + ",batteryPercent=80,boxBatteryPercent=60 1700000000000000000"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestValidateBatteryProfiles(t *testing.T) {
+	if err := validateBatteryProfiles(defaultBatteryProfiles); err != nil {
+		t.Errorf("default profiles: %v", err)
+	}
+
+	repeated := []BatteryProfile{
+		{Measurement: "SmartLight", Field: "boardVoltage", Chemistry: "li-socl2"},
+		{Measurement: "SmartLight", Field: "batteryVoltage", Chemistry: "liion", Scale: 0.001},
+	}
+	if err := validateBatteryProfiles(repeated); err == nil {
+		t.Error("profiles writing the same fields were accepted")
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// DiskBuffer is a write-ahead buffer of Kafka records kept in segment files while the brokers
+// are unreachable. Records are appended to the newest segment and drained from the oldest one.
+//
+// Each record is stored as: uint32 topic length, topic, uint32 value length, value (big endian).
+type DiskBuffer struct {
+	mu sync.Mutex
+
+	dir             string
+	maxSegmentBytes int64
+	maxSegmentAge   time.Duration
+	maxBytes        int64
+	retention       time.Duration
+
+	segments []bufferSegment // oldest first, the last one may be active
+	active   *os.File
+	sequence int64
+}
+
+type bufferSegment struct {
+	path    string
+	size    int64
+	records int64
+	created time.Time
+}
+
+type BufferedRecord struct {
+	Topic string
+	Value []byte
+}
+
+const bufferSegmentExt = ".seg"
+
+func newDiskBuffer(dir string, maxSegmentBytes int64, maxSegmentAge time.Duration, maxBytes int64, retention time.Duration) (*DiskBuffer, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	b := &DiskBuffer{
+		dir:             dir,
+		maxSegmentBytes: maxSegmentBytes,
+		maxSegmentAge:   maxSegmentAge,
+		maxBytes:        maxBytes,
+		retention:       retention,
+	}
+
+	// Recover the segments left by a previous run
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+bufferSegmentExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	if len(paths) > 0 {
+		fmt.Sscanf(filepath.Base(paths[len(paths)-1]), "%d", &b.sequence)
+	}
+	for _, path := range paths {
+		records, size, err := readSegment(path)
+		if err != nil {
+			fmt.Printf("Buffer segment %s is truncated, keeping %d records: %v\n", path, len(records), err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		b.segments = append(b.segments, bufferSegment{path: path, size: size, records: int64(len(records)), created: info.ModTime()})
+	}
+
+	b.updateMetrics()
+	return b, nil
+}
+
+// Append stores a record at the end of the buffer and syncs it to disk.
+func (b *DiskBuffer) Append(topic string, value []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expire()
+
+	if b.active != nil {
+		segment := b.segments[len(b.segments)-1]
+		if segment.size >= b.maxSegmentBytes || time.Since(segment.created) >= b.maxSegmentAge {
+			b.seal()
+		}
+	}
+	if b.active == nil {
+		if err := b.open(); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, 0, 8+len(topic)+len(value))
+	record = binary.BigEndian.AppendUint32(record, uint32(len(topic)))
+	record = append(record, topic...)
+	record = binary.BigEndian.AppendUint32(record, uint32(len(value)))
+	record = append(record, value...)
+
+	if _, err := b.active.Write(record); err != nil {
+		return err
+	}
+	if err := b.active.Sync(); err != nil {
+		return err
+	}
+
+	segment := &b.segments[len(b.segments)-1]
+	segment.size += int64(len(record))
+	segment.records++
+
+	// Keep the buffer bounded by discarding the oldest data
+	for b.size() > b.maxBytes && len(b.segments) > 1 {
+		fmt.Printf("Buffer is full, discarding %d records from %s\n", b.segments[0].records, b.segments[0].path)
+		bufferDropped.Add(b.segments[0].records)
+		b.remove()
+	}
+
+	b.updateMetrics()
+	return nil
+}
+
+// Drain sends the buffered records one segment at a time, oldest first, until the buffer is
+// empty or send fails. A segment is removed only after all of its records were sent, so a
+// failure in the middle of a segment may send some records again on the next drain.
+func (b *DiskBuffer) Drain(send func(records []BufferedRecord) error) error {
+	for {
+		b.mu.Lock()
+		b.expire()
+		if len(b.segments) == 0 {
+			b.mu.Unlock()
+			return nil
+		}
+		if len(b.segments) == 1 && b.active != nil {
+			b.seal()
+		}
+		path := b.segments[0].path
+		b.mu.Unlock()
+
+		records, _, err := readSegment(path)
+		if err != nil {
+			fmt.Printf("Buffer segment %s is truncated, draining %d records: %v\n", path, len(records), err)
+		}
+		if err := send(records); err != nil {
+			return err
+		}
+
+		b.mu.Lock()
+		if len(b.segments) > 0 && b.segments[0].path == path {
+			b.remove()
+		}
+		b.updateMetrics()
+		b.mu.Unlock()
+	}
+}
+
+// Depth returns the number of buffered records.
+func (b *DiskBuffer) Depth() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var records int64
+	for _, segment := range b.segments {
+		records += segment.records
+	}
+	return records
+}
+
+func (b *DiskBuffer) open() error {
+	// Segment names sort in creation order
+	b.sequence = max(time.Now().UnixNano(), b.sequence+1)
+	name := fmt.Sprintf("%020d%s", b.sequence, bufferSegmentExt)
+	path := filepath.Join(b.dir, name)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	b.active = f
+	b.segments = append(b.segments, bufferSegment{path: path, created: time.Now()})
+	return nil
+}
+
+func (b *DiskBuffer) seal() {
+	if err := b.active.Close(); err != nil {
+		fmt.Printf("Closing buffer segment: %v\n", err)
+	}
+	b.active = nil
+}
+
+// remove deletes the oldest segment.
+func (b *DiskBuffer) remove() {
+	if b.active != nil && len(b.segments) == 1 {
+		b.seal()
+	}
+	if err := os.Remove(b.segments[0].path); err != nil {
+		fmt.Printf("Removing buffer segment: %v\n", err)
+	}
+	b.segments = b.segments[1:]
+}
+
+// expire discards segments older than the retention period.
+func (b *DiskBuffer) expire() {
+	if b.retention <= 0 {
+		return
+	}
+	for len(b.segments) > 0 && time.Since(b.segments[0].created) > b.retention {
+		fmt.Printf("Buffer retention exceeded, discarding %d records from %s\n", b.segments[0].records, b.segments[0].path)
+		bufferDropped.Add(b.segments[0].records)
+		b.remove()
+	}
+}
+
+func (b *DiskBuffer) size() int64 {
+	var size int64
+	for _, segment := range b.segments {
+		size += segment.size
+	}
+	return size
+}
+
+func (b *DiskBuffer) updateMetrics() {
+	var records int64
+	for _, segment := range b.segments {
+		records += segment.records
+	}
+	bufferDepth.Set(records)
+	bufferBytes.Set(b.size())
+	bufferSegments.Set(int64(len(b.segments)))
+}
+
+// readSegment reads every complete record of a segment file. A partially written record at the
+// end of the file, e.g. after a crash, is reported as an error and skipped.
+func readSegment(path string) ([]BufferedRecord, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var records []BufferedRecord
+	var size int64
+	r := bufio.NewReader(f)
+
+	for {
+		topic, err := readChunk(r)
+		if err == io.EOF {
+			return records, size, nil
+		}
+		if err != nil {
+			return records, size, err
+		}
+		value, err := readChunk(r)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return records, size, err
+		}
+		records = append(records, BufferedRecord{Topic: string(topic), Value: value})
+		size += int64(8 + len(topic) + len(value))
+	}
+}
+
+func readChunk(r *bufio.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	chunk := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(r, chunk); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// kafkaHeaders are the headers of every record produced by the gateway. They do not depend on
+// the record, so the buffer does not store them and drainBuffer sets them again.
+var kafkaHeaders = []kafka.Header{{Key: "myTestHeader", Value: []byte("header values are binary")}}
+
+// drainBuffer periodically moves the buffered records back to Kafka once it is reachable again.
+func drainBuffer(buffer *DiskBuffer, kafkaProdClient *kafka.Producer, interval time.Duration) {
+	for range time.Tick(interval) {
+		depth := buffer.Depth()
+		if depth == 0 {
+			continue
+		}
+
+		fmt.Printf("Draining %d buffered records\n", depth)
+		err := buffer.Drain(func(records []BufferedRecord) error {
+			deliveryChan := make(chan kafka.Event, len(records))
+			for i := range records {
+				err := kafkaProdClient.Produce(&kafka.Message{
+					TopicPartition: kafka.TopicPartition{Topic: &records[i].Topic, Partition: kafka.PartitionAny},
+					Value:          records[i].Value,
+					Headers:        kafkaHeaders,
+				}, deliveryChan)
+				if err != nil {
+					return err
+				}
+			}
+
+			var failed error
+			for range records {
+				if ev, ok := (<-deliveryChan).(*kafka.Message); ok && ev.TopicPartition.Error != nil {
+					failed = ev.TopicPartition.Error
+				}
+			}
+			return failed
+		})
+		if err != nil {
+			fmt.Printf("Draining buffer failed, %d records left: %v\n", buffer.Depth(), err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TemperatureEnvelope is the temperature range, in °C, an organ must be kept in during transport, e.g.
+// {"min": 2, "max": 8, "fields": ["temperaturacuba1", "temperaturacuba2"]}
+type TemperatureEnvelope struct {
+	Min    float64  `json:"min"`
+	Max    float64  `json:"max"`
+	Fields []string `json:"fields"` // Tracking fields checked, temperaturacuba1 when empty
+}
+
+// defaultTemperatureEnvelopes is the static cold storage range by organ. "*" applies to the organs
+// missing in the table, temperature_envelopes of the schema overrides it.
+var defaultTemperatureEnvelopes = map[string]TemperatureEnvelope{
+	"*": {Min: 2, Max: 8},
+}
+
+// Transport is an organ transport of a box, from its ischemia timer starting until it stops.
+type Transport struct {
+	Id             string        `json:"id"` // numtransplante, else idModal
+	Organ          string        `json:"organ"`
+	NumTransplante string        `json:"numTransplante"`
+	IdModal        string        `json:"idModal"`
+	Start          int64         `json:"start"`      // ns
+	LastSample     int64         `json:"lastSample"` // ns
+	LastOutOfRange bool          `json:"lastOutOfRange"`
+	OutOfRange     time.Duration `json:"outOfRange"` // ns
+	Excursions     int           `json:"excursions"`
+	Samples        int           `json:"samples"`
+	Min            float64       `json:"min"`
+	Max            float64       `json:"max"`
+}
+
+// transports is keyed by deviceId and only touched from the main loop goroutine.
+var transports = make(map[string]*Transport)
+
+var (
+	// transportFile keeps the running transports across restarts when set
+	transportFile string
+	// Samples are saved at most every transportSaveInterval, and by the liveness ticker
+	transportSaveInterval = time.Minute
+
+	transportsSaved time.Time
+	transportsDirty bool
+)
+
+// trackTransport starts a transport when the ischemia timer of a parsed Ischemia record starts,
+// and ends it with a TransportSummary record when the timer stops or a record names another transport.
+func trackTransport(message string, deviceType string, etc string, now time.Time) {
+	line, ok := parseLine(message)
+	if !ok {
+		return
+	}
+	deviceId := line.Tags["deviceId"]
+	timestamp := line.Timestamp
+	if timestamp == 0 {
+		timestamp = now.UnixNano()
+	}
+
+	numTransplante := fieldKeyUnescaper.Replace(line.Tags["numtransplante"])
+	idModal := stringFieldUnescaper.Replace(strings.Trim(line.Fields["idModal"], `"`))
+	id := numTransplante
+	if id == "" {
+		id = idModal
+	}
+
+	ischemia, running := ischemiaStates[deviceId]
+	running = running && ischemia.Running
+
+	transport, ok := transports[deviceId]
+	if ok && (!running || (id != "" && transport.Id != id)) {
+		emitRecord(transportSummary(deviceId, deviceType, etc, transport, timestamp))
+		delete(transports, deviceId)
+		saveTransports()
+		ok = false
+	}
+	if running && !ok {
+		transports[deviceId] = &Transport{
+			Id:             id,
+			Organ:          strings.ToLower(fieldKeyUnescaper.Replace(line.Tags["orgao"])),
+			NumTransplante: numTransplante,
+			IdModal:        idModal,
+			Start:          timestamp,
+		}
+		fmt.Printf("\nTransport %s of %s started", privacyLogId(id), deviceId)
+		saveTransports()
+	}
+}
+
+// trackColdChain adds the temperatures of a parsed Tracking record to the running transport of
+// the device. Time is out of range from a sample outside the organ envelope until the next sample.
+func trackColdChain(message string, now time.Time) {
+	line, ok := parseLine(message)
+	if !ok {
+		return
+	}
+	transport, ok := transports[line.Tags["deviceId"]]
+	if !ok {
+		return
+	}
+	timestamp := line.Timestamp
+	if timestamp == 0 {
+		timestamp = now.UnixNano()
+	}
+
+	envelope := temperatureEnvelope(transport.Organ)
+	fields := envelope.Fields
+	if len(fields) == 0 {
+		fields = []string{"temperaturacuba1"}
+	}
+
+	sampled := false
+	outOfRange := false
+	for _, field := range fields {
+		temperature, ok := fieldFloat(line.Fields[field])
+		if !ok {
+			continue
+		}
+		first := transport.Samples == 0 && !sampled
+		if first || temperature < transport.Min {
+			transport.Min = temperature
+		}
+		if first || temperature > transport.Max {
+			transport.Max = temperature
+		}
+		sampled = true
+		if temperature < envelope.Min || temperature > envelope.Max {
+			outOfRange = true
+		}
+	}
+	if !sampled || timestamp < transport.LastSample {
+		return
+	}
+
+	if transport.LastOutOfRange && transport.LastSample != 0 {
+		transport.OutOfRange += time.Duration(timestamp - transport.LastSample)
+	}
+	if outOfRange && !transport.LastOutOfRange {
+		transport.Excursions++
+	}
+	transport.Samples++
+	transport.LastSample = timestamp
+	transport.LastOutOfRange = outOfRange
+
+	transportsDirty = true
+	if time.Since(transportsSaved) >= transportSaveInterval {
+		saveTransports()
+	}
+}
+
+// flushTransports saves the samples added since the last save.
+func flushTransports() {
+	if transportsDirty {
+		saveTransports()
+	}
+}
+
+// loadTransports restores the transports saved in transportFile.
+func loadTransports() error {
+	if transportFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(transportFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &transports); err != nil {
+		return fmt.Errorf("parsing %s: %w", transportFile, err)
+	}
+	fmt.Printf("Restored %d running transports\n", len(transports))
+	return nil
+}
+
+// saveTransports writes the running transports to transportFile, replacing it atomically.
+func saveTransports() {
+	if transportFile == "" {
+		return
+	}
+	transportsSaved = time.Now()
+	transportsDirty = false
+
+	b, err := json.Marshal(transports)
+	if err != nil {
+		fmt.Printf("\nSaving transports failed: %v", err)
+		return
+	}
+	tmp := filepath.Join(filepath.Dir(transportFile), "."+filepath.Base(transportFile)+".tmp")
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		fmt.Printf("\nSaving transports failed: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, transportFile); err != nil {
+		fmt.Printf("\nSaving transports failed: %v", err)
+	}
+}
+
+// transportSummary formats an ended transport as
+// TransportSummary,deviceId=,deviceType=,direction=event,origin=,orgao=,numtransplante= idModal=,start=,durationSeconds=,outOfRangeSeconds=,excursions=,samples=,minTemperature=,maxTemperature=,envelopeMin=,envelopeMax=,compliant= timestamp
+func transportSummary(deviceId string, deviceType string, etc string, transport *Transport, end int64) string {
+	var sb strings.Builder
+
+	// Time out of range up to the end of the transport
+	if transport.LastOutOfRange && end > transport.LastSample {
+		transport.OutOfRange += time.Duration(end - transport.LastSample)
+	}
+	envelope := temperatureEnvelope(transport.Organ)
+
+	sb.WriteString(`TransportSummary`)
+
+	// Tags
+	sb.WriteString(`,deviceId=`)
+	sb.WriteString(deviceId)
+	sb.WriteString(`,deviceType=`)
+	sb.WriteString(deviceType)
+	sb.WriteString(`,direction=event`)
+	sb.WriteString(`,origin=`)
+	sb.WriteString(etc)
+	if transport.Organ != "" {
+		sb.WriteString(`,orgao=`)
+		sb.WriteString(tagValueEscaper.Replace(transport.Organ))
+	}
+	if transport.NumTransplante != "" {
+		sb.WriteString(`,numtransplante=`)
+		sb.WriteString(tagValueEscaper.Replace(transport.NumTransplante))
+	}
+
+	// Fields
+	sb.WriteString(` `)
+	if transport.IdModal != "" {
+		sb.WriteString(`idModal="`)
+		sb.WriteString(fieldStringEscaper.Replace(transport.IdModal))
+		sb.WriteString(`",`)
+	}
+	sb.WriteString(`start="`)
+	sb.WriteString(time.Unix(0, transport.Start).UTC().Format(time.RFC3339))
+	sb.WriteString(`",durationSeconds=`)
+	sb.WriteString(strconv.FormatFloat(time.Duration(end-transport.Start).Seconds(), 'f', 0, 64))
+	sb.WriteString(`,outOfRangeSeconds=`)
+	sb.WriteString(strconv.FormatFloat(transport.OutOfRange.Seconds(), 'f', 0, 64))
+	sb.WriteString(`,excursions=`)
+	sb.WriteString(strconv.Itoa(transport.Excursions))
+	sb.WriteString(`i,samples=`)
+	sb.WriteString(strconv.Itoa(transport.Samples))
+	sb.WriteString(`i`)
+	if transport.Samples > 0 {
+		sb.WriteString(`,minTemperature=`)
+		sb.WriteString(strconv.FormatFloat(transport.Min, 'f', -1, 64))
+		sb.WriteString(`,maxTemperature=`)
+		sb.WriteString(strconv.FormatFloat(transport.Max, 'f', -1, 64))
+	}
+	sb.WriteString(`,envelopeMin=`)
+	sb.WriteString(strconv.FormatFloat(envelope.Min, 'f', -1, 64))
+	sb.WriteString(`,envelopeMax=`)
+	sb.WriteString(strconv.FormatFloat(envelope.Max, 'f', -1, 64))
+	sb.WriteString(`,compliant=`)
+	sb.WriteString(strconv.FormatBool(transport.Samples > 0 && transport.Excursions == 0))
+
+	// Timestamp_ns
+	sb.WriteString(` `)
+	sb.WriteString(strconv.FormatInt(end, 10))
+
+	fmt.Printf("\nTransport %s of %s ended, %s out of range", privacyLogId(transport.Id), deviceId, transport.OutOfRange.Round(time.Second))
+
+	return sb.String()
+}
+
+func temperatureEnvelope(organ string) TemperatureEnvelope {
+	if envelope, ok := schema.TemperatureEnvelopes[organ]; ok {
+		return envelope
+	}
+	if envelope, ok := defaultTemperatureEnvelopes[organ]; ok {
+		return envelope
+	}
+	if envelope, ok := schema.TemperatureEnvelopes["*"]; ok {
+		return envelope
+	}
+	return defaultTemperatureEnvelopes["*"]
+}
+
+func validateTemperatureEnvelopes(envelopes map[string]TemperatureEnvelope) error {
+	for organ, envelope := range envelopes {
+		if envelope.Min > envelope.Max {
+			return fmt.Errorf("temperature envelope %q has min greater than max", organ)
+		}
+	}
+	return nil
+}
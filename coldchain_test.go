@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransportRestored(t *testing.T) {
+	transportFile = filepath.Join(t.TempDir(), "transports.json")
+	t.Cleanup(func() {
+		transportFile = ""
+		transports = make(map[string]*Transport)
+		ischemiaStates = make(map[string]*IschemiaState)
+		pendingRecords = pendingRecords[:0]
+	})
+	transports = make(map[string]*Transport)
+	ischemiaStates = make(map[string]*IschemiaState)
+	now := time.Now()
+
+	ischemia := func(seconds string, timestamp string) {
+		record := `Ischemia,deviceId=HP01,deviceType=HealthPack,orgao=rim,numtransplante=TX-2024-001 tempo_restante_isquemia=` + seconds + `,tempo_total_isquemia=` + seconds + ` ` + timestamp
+		checkIschemia(record, "HealthPack", "imt", now)
+		trackTransport(record, "HealthPack", "imt", now)
+	}
+
+	ischemia("3600", "1700000000000000000")
+	trackColdChain(`Tracking,deviceId=HP01 temperaturacuba1=12 1700000060000000000`, now)
+	trackColdChain(`Tracking,deviceId=HP01 temperaturacuba1=5 1700000120000000000`, now)
+	flushTransports()
+
+	// The gateway restarts during the transport
+	transports = make(map[string]*Transport)
+	ischemiaStates = make(map[string]*IschemiaState)
+	if err := loadTransports(); err != nil {
+		t.Fatal(err)
+	}
+	pendingRecords = pendingRecords[:0]
+
+	ischemia("0", "1700000300000000000")
+	var summaries []string
+	for _, pending := range pendingRecords {
+		if strings.HasPrefix(pending.Value, "TransportSummary,") {
+			summaries = append(summaries, pending.Value)
+		}
+	}
+	if len(summaries) != 1 {
+		t.Fatalf("want one summary, got %q", summaries)
+	}
+	for _, want := range []string{"durationSeconds=300,", "outOfRangeSeconds=60,", "excursions=1i,", "samples=2i,"} {
+		if !strings.Contains(summaries[0], want) {
+			t.Errorf("no %s in %s", want, summaries[0])
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// getEnv returns the value of the environment variable key or fallback when it is unset or empty.
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvBool parses the environment variable key as a bool, returning fallback when unset or invalid.
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		fmt.Printf("Invalid value for %s: %v\n", key, err)
+		return fallback
+	}
+	return b
+}
+
+// getEnvInt parses the environment variable key as an int64, returning fallback when unset or invalid.
+func getEnvInt(key string, fallback int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		fmt.Printf("Invalid value for %s: %v\n", key, err)
+		return fallback
+	}
+	return i
+}
+
+// getEnvFloat parses the environment variable key as a float64, returning fallback when unset or invalid.
+func getEnvFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		fmt.Printf("Invalid value for %s: %v\n", key, err)
+		return fallback
+	}
+	return f
+}
+
+// getEnvDuration parses the environment variable key as a time.Duration, e.g. "90s" or "1h".
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		fmt.Printf("Invalid value for %s: %v\n", key, err)
+		return fallback
+	}
+	return d
+}
+
+// getSecret reads a credential from the environment. KEY_FILE takes precedence over KEY
+// so that values can come from mounted secrets instead of plain environment variables.
+func getSecret(key string, fallback string) string {
+	if file := os.Getenv(key + "_FILE"); file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			panic(fmt.Errorf("reading %s_FILE: %w", key, err))
+		}
+		return strings.TrimRight(string(b), "\r\n")
+	}
+	return getEnv(key, fallback)
+}
+
+// mqttTLSConfig builds the TLS configuration for the MQTT client from MQTT_TLS_* variables.
+// It returns nil when TLS is not enabled and no CA or client certificate is given.
+func mqttTLSConfig() (*tls.Config, error) {
+	caFile := os.Getenv("MQTT_TLS_CA_FILE")
+	certFile := os.Getenv("MQTT_TLS_CERT_FILE")
+	keyFile := os.Getenv("MQTT_TLS_KEY_FILE")
+
+	if !getEnvBool("MQTT_TLS", false) && caFile == "" && certFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         os.Getenv("MQTT_TLS_SERVER_NAME"),
+		InsecureSkipVerify: getEnvBool("MQTT_TLS_INSECURE_SKIP_VERIFY", false),
+	}
+
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading MQTT_TLS_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading MQTT client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// kafkaConfigMap builds the producer configuration from KAFKA_* variables.
+// Only the settings that are present are added, so plaintext brokers keep working unchanged.
+func kafkaConfigMap(kafkaBroker string) *kafka.ConfigMap {
+	configMap := &kafka.ConfigMap{"bootstrap.servers": kafkaBroker}
+
+	settings := map[string]string{
+		"security.protocol":                     os.Getenv("KAFKA_SECURITY_PROTOCOL"),
+		"sasl.mechanisms":                       os.Getenv("KAFKA_SASL_MECHANISM"),
+		"sasl.username":                         getSecret("KAFKA_SASL_USERNAME", ""),
+		"sasl.password":                         getSecret("KAFKA_SASL_PASSWORD", ""),
+		"ssl.ca.location":                       os.Getenv("KAFKA_SSL_CA_LOCATION"),
+		"ssl.certificate.location":              os.Getenv("KAFKA_SSL_CERTIFICATE_LOCATION"),
+		"ssl.key.location":                      os.Getenv("KAFKA_SSL_KEY_LOCATION"),
+		"ssl.key.password":                      getSecret("KAFKA_SSL_KEY_PASSWORD", ""),
+		"ssl.endpoint.identification.algorithm": os.Getenv("KAFKA_SSL_ENDPOINT_IDENTIFICATION_ALGORITHM"),
+		"message.timeout.ms":                    os.Getenv("KAFKA_MESSAGE_TIMEOUT_MS"),
+	}
+	for key, value := range settings {
+		if value != "" {
+			configMap.SetKey(key, value)
+		}
+	}
+
+	return configMap
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CounterConfig converts the cumulative counters of a device, e.g. a Hydrometer giving 10 liters
+// per pulse: {"factor": 10}.
+type CounterConfig struct {
+	Factor float64 `json:"factor"` // units per count, 1 when unset
+	Bits   uint    `json:"bits"`   // counter width, overrides the width decoded for the device type
+}
+
+type CounterState struct {
+	Value     float64
+	Timestamp int64
+}
+
+// counterStates is keyed by deviceId/counter and only touched from the main loop goroutine.
+var counterStates = make(map[string]*CounterState)
+
+// counterDelta returns the increase of a cumulative counter since its previous reading. A counter
+// that went down wrapped when modulus is set and the wrapped increase is plausible, otherwise
+// the device was reset and the counter restarted from zero. It returns false for the first
+// reading or when the reading is not newer than the previous one.
+func counterDelta(key string, value float64, modulus float64, timestamp int64) (delta float64, elapsed time.Duration, ok bool) {
+	state, found := counterStates[key]
+	if !found {
+		counterStates[key] = &CounterState{Value: value, Timestamp: timestamp}
+		return 0, 0, false
+	}
+	if timestamp <= state.Timestamp {
+		return 0, 0, false
+	}
+
+	switch {
+	case value >= state.Value:
+		delta = value - state.Value
+	case modulus > 0 && modulus-state.Value+value < modulus/2:
+		delta = modulus - state.Value + value
+	default:
+		fmt.Printf("\nCounter %s reset from %v to %v", key, state.Value, value)
+		delta = value
+	}
+
+	elapsed = time.Duration(timestamp - state.Timestamp)
+	state.Value = value
+	state.Timestamp = timestamp
+	return delta, elapsed, true
+}
+
+// energyMeterStep is the kWh of one count of the 32 bit EnergyMeter registers, decoded as
+// count * (150 / 5) / 2000.
+const energyMeterStep = 150.0 / 5 / 2000
+
+// counterFields formats the increase of the counter name since the previous uplink, scaled by
+// the factor of the device, as {name}Delta and its rate per rateUnit as rateName. bits is the
+// width of the raw counter, 0 when it does not wrap, and step the value of one raw count, so a
+// counter decoded in other units wraps at 2^bits * step.
+func counterFields(deviceId string, measurement string, name string, value float64, bits uint, step float64, timestamp int64, rateName string, rateUnit time.Duration) string {
+	var sb strings.Builder
+
+	factor := 1.0
+	if device := lookupDevice(deviceId, measurement); device != nil && device.Counter != nil {
+		if device.Counter.Factor != 0 {
+			factor = device.Counter.Factor
+		}
+		if device.Counter.Bits != 0 {
+			bits = device.Counter.Bits
+		}
+	}
+
+	var modulus float64
+	if bits > 0 {
+		modulus = math.Pow(2, float64(bits)) * step
+	}
+
+	delta, elapsed, ok := counterDelta(deviceId+"/"+name, value, modulus, timestamp)
+	if !ok {
+		return ""
+	}
+	delta = delta * factor
+	rate := delta / (float64(elapsed) / float64(rateUnit))
+
+	sb.WriteString(`,`)
+	sb.WriteString(name)
+	sb.WriteString(`Delta=`)
+	sb.WriteString(strconv.FormatFloat(roundFloat(delta, 4), 'f', -1, 64))
+	sb.WriteString(`,`)
+	sb.WriteString(rateName)
+	sb.WriteString(`=`)
+	sb.WriteString(strconv.FormatFloat(roundFloat(rate, 4), 'f', -1, 64))
+
+	return sb.String()
+}
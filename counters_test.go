@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounterFieldsEnergyMeterWrap(t *testing.T) {
+	t.Cleanup(func() { counterStates = make(map[string]*CounterState) })
+
+	// kWh as decoded from the raw 32 bit register
+	kWh := func(raw uint64) float64 { return float64(raw) * (150 / 5) / 2000 }
+	start := time.Date(2025, 10, 19, 10, 0, 0, 0, time.UTC).UnixNano()
+	hour := int64(time.Hour)
+
+	tests := []struct {
+		name string
+		raw  uint64
+		want string
+	}{
+		{"first reading", 1<<32 - 100, ""},
+		{"wrapped by 150 counts", 50, ",forwardEnergyDelta=2.25,forwardPower=2.25"},
+		{"counting up", 250, ",forwardEnergyDelta=3,forwardPower=3"},
+		{"meter reset", 10, ",forwardEnergyDelta=0.15,forwardPower=0.15"},
+	}
+	for i, tt := range tests {
+		got := counterFields("0004a30b00000002", "EnergyMeter", "forwardEnergy", kWh(tt.raw), 32, energyMeterStep, start+int64(i)*hour, "forwardPower", time.Hour)
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DedupCache remembers message keys for a time window so that copies of the same uplink,
+// received through several gateways or network servers, are forwarded only once.
+type DedupCache struct {
+	window    time.Duration
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func newDedupCache(window time.Duration) *DedupCache {
+	return &DedupCache{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Seen reports whether any of keys was seen within the window and records all of them.
+func (d *DedupCache) Seen(now time.Time, keys ...string) bool {
+	if now.Sub(d.lastSweep) > d.window {
+		for key, t := range d.seen {
+			if now.Sub(t) > d.window {
+				delete(d.seen, key)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	duplicate := false
+	for _, key := range keys {
+		if t, ok := d.seen[key]; ok && now.Sub(t) <= d.window {
+			duplicate = true
+		}
+	}
+	for _, key := range keys {
+		if _, ok := d.seen[key]; !ok || !duplicate {
+			d.seen[key] = now
+		}
+	}
+	return duplicate
+}
+
+// lnsDedupKeys returns the keys identifying an uplink. The (devEUI, fCnt, payload hash) key is
+// always included so that a ChirpStack v4 copy, which carries a deduplicationId, also matches
+// the copy of the same uplink received from the imt network server, which does not.
+func lnsDedupKeys(lnsUp LnsUp, deduplicationId string) []string {
+	hash := sha256.Sum256([]byte(lnsUp.Data))
+
+	var sb strings.Builder
+	sb.WriteString("uplink/")
+	sb.WriteString(strings.ToLower(lnsUp.DeviceId))
+	sb.WriteString("/")
+	sb.WriteString(strconv.FormatUint(lnsUp.FCnt, 10))
+	sb.WriteString("/")
+	sb.WriteString(hex.EncodeToString(hash[:8]))
+
+	keys := []string{sb.String()}
+	if deduplicationId != "" {
+		keys = append(keys, "deduplicationId/"+deduplicationId)
+	}
+	return keys
+}
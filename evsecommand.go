@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// OcppField is a property of an OCPP 1.6 request, after its JSON schema.
+type OcppField struct {
+	Type      string // integer, string or object
+	Required  bool
+	Enum      []string // allowed strings
+	Min       int64    // minimum integer
+	MaxLength int      // maximum string length
+}
+
+// evseCommands are the OCPP 1.6 requests the backend can send to a charger. Other properties are
+// rejected, as the OCPP schemas do not allow additional properties.
+var evseCommands = map[string]map[string]OcppField{
+	"RemoteStartTransaction": {
+		"connectorId":     {Type: "integer", Min: 1},
+		"idTag":           {Type: "string", Required: true, MaxLength: 20},
+		"chargingProfile": {Type: "object"},
+	},
+	"RemoteStopTransaction": {
+		"transactionId": {Type: "integer", Required: true},
+	},
+	"ChangeAvailability": {
+		"connectorId": {Type: "integer", Required: true},
+		"type":        {Type: "string", Required: true, Enum: []string{"Inoperative", "Operative"}},
+	},
+	"Reset": {
+		"type": {Type: "string", Required: true, Enum: []string{"Hard", "Soft"}},
+	},
+	"UnlockConnector": {
+		"connectorId": {Type: "integer", Required: true, Min: 1},
+	},
+}
+
+var (
+	// evseCommandClient publishes the commands on a connection of its own, as the subscriber one
+	// does not take acknowledgements while the main loop handles a message
+	evseCommandClient MQTT.Client
+	// evseCommandTopic is where the charger receives a command, {deviceId} and {command} are replaced
+	evseCommandTopic   = "ocpp/{deviceId}/{command}"
+	evseCommandQos     = byte(1)
+	evseCommandTimeout = 10 * time.Second
+	// evseCommandDedup drops the copies of a command seen within DEDUP_WINDOW, nil when disabled
+	evseCommandDedup *DedupCache
+	// evseCommandResults takes the records of the commands the broker did not confirm to the main loop
+	evseCommandResults = make(chan string, 64)
+)
+
+// parseEvseCommand validates a command sent to OpenDataTelemetry/{organization}/EVSE/{command}/{deviceId}/down,
+// forwards it to the command topic of the charger and returns its record:
+// {command},deviceId=,deviceType=,direction=down,origin=,status=forwarded|rejected|failed|duplicate {properties},error= timestamp
+// A command carrying the messageId of one already seen is a copy redelivered by the broker and is
+// not forwarded again. A forwarded command the broker does not confirm gets a second record with
+// status=failed, sent to evseCommandResults.
+func parseEvseCommand(organization string, command string, deviceType string, deviceId string, etc string, message string) string {
+	messageId, message := evseCommandMessageId(message)
+	properties, err := validateEvseCommand(organization, command, deviceId, etc, message)
+	if messageId != "" {
+		properties["messageId"] = `"` + fieldStringEscaper.Replace(messageId) + `"`
+	}
+
+	status := "rejected"
+	if err == nil {
+		status = "forwarded"
+		if messageId != "" && evseCommandDedup != nil && evseCommandDedup.Seen(time.Now(), "command/"+deviceId+"/"+command+"/"+messageId) {
+			status = "duplicate"
+			fmt.Printf("\nEVSE command %s to %s dropped as a duplicate", command, deviceId)
+		} else {
+			err = publishEvseCommand(command, deviceId, message, func(err error) {
+				evseCommandResults <- evseCommandRecord(command, deviceType, deviceId, etc, "failed", properties, err)
+			})
+			if err != nil {
+				status = "failed"
+			}
+		}
+	}
+	if err != nil {
+		fmt.Printf("\nEVSE command %s to %s %s: %v", command, deviceId, status, err)
+	}
+
+	return evseCommandRecord(command, deviceType, deviceId, etc, status, properties, err)
+}
+
+// evseCommandRecord formats the record of a command, with err as its error field when not nil.
+func evseCommandRecord(command string, deviceType string, deviceId string, etc string, status string, properties map[string]string, err error) string {
+	var sb strings.Builder
+
+	// Measurement
+	sb.WriteString(command)
+
+	// Tags
+	writeTag(&sb, "deviceId", deviceId)
+	writeTag(&sb, "deviceType", deviceType)
+	sb.WriteString(`,direction=down`)
+	writeTag(&sb, "origin", etc)
+	sb.WriteString(`,status=`)
+	sb.WriteString(status)
+
+	// Fields
+	sb.WriteString(` `)
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		if i > 0 {
+			sb.WriteString(`,`)
+		}
+		sb.WriteString(key)
+		sb.WriteString(`=`)
+		sb.WriteString(properties[key])
+	}
+	if err != nil {
+		if len(keys) > 0 {
+			sb.WriteString(`,`)
+		}
+		sb.WriteString(`error="`)
+		sb.WriteString(fieldStringEscaper.Replace(err.Error()))
+		sb.WriteString(`"`)
+	} else if len(keys) == 0 {
+		sb.WriteString(`command=true`)
+	}
+
+	// Timestamp_ns
+	sb.WriteString(` `)
+	sb.WriteString(strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	return sb.String()
+}
+
+// validateEvseCommand checks message against the OCPP 1.6 schema of command and returns its
+// properties as line protocol field values, which are kept for the record when it is rejected.
+// The command topic of the charger does not carry the organization, so only chargers registered
+// in the organization of the command are accepted.
+func validateEvseCommand(organization string, command string, deviceId string, etc string, message string) (map[string]string, error) {
+	properties := make(map[string]string)
+
+	fields, ok := evseCommands[command]
+	if !ok {
+		return properties, fmt.Errorf("unknown command %s", command)
+	}
+	if deviceOrganization(deviceId, "EVSE") != organization {
+		return properties, fmt.Errorf("%s is not a charger of %s", deviceId, organization)
+	}
+	if version := ocppVersion(deviceId, etc); version != "1.6" {
+		return properties, fmt.Errorf("commands to OCPP %s chargers are not supported", version)
+	}
+
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(message), &payload); err != nil {
+		return properties, fmt.Errorf("payload is not a JSON object: %w", err)
+	}
+
+	var errs []string
+	for key, raw := range payload {
+		field, ok := fields[key]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s is not allowed", key))
+			continue
+		}
+
+		switch field.Type {
+		case "integer":
+			var value int64
+			if err := json.Unmarshal(raw, &value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s must be an integer", key))
+				continue
+			}
+			properties[key] = strconv.FormatInt(value, 10)
+			if value < field.Min {
+				errs = append(errs, fmt.Sprintf("%s must be at least %d", key, field.Min))
+			}
+
+		case "string":
+			var value string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				errs = append(errs, fmt.Sprintf("%s must be a string", key))
+				continue
+			}
+			properties[key] = `"` + fieldStringEscaper.Replace(value) + `"`
+			if field.MaxLength > 0 && len(value) > field.MaxLength {
+				errs = append(errs, fmt.Sprintf("%s is longer than %d", key, field.MaxLength))
+			}
+			if len(field.Enum) > 0 && !contains(field.Enum, value) {
+				errs = append(errs, fmt.Sprintf("%s must be one of %s", key, strings.Join(field.Enum, ", ")))
+			}
+
+		case "object":
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, raw); err != nil || !bytes.HasPrefix(compact.Bytes(), []byte(`{`)) {
+				errs = append(errs, fmt.Sprintf("%s must be an object", key))
+				continue
+			}
+			properties[key] = `"` + fieldStringEscaper.Replace(compact.String()) + `"`
+		}
+	}
+	for key, field := range fields {
+		if _, ok := payload[key]; field.Required && !ok {
+			errs = append(errs, fmt.Sprintf("%s is required", key))
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return properties, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return properties, nil
+}
+
+// evseCommandMessageId takes the messageId the backend may add to a command out of its payload,
+// as the OCPP schemas do not allow it.
+func evseCommandMessageId(message string) (string, string) {
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(message), &payload); err != nil {
+		return "", message
+	}
+	raw, ok := payload["messageId"]
+	if !ok {
+		return "", message
+	}
+	var messageId string
+	if err := json.Unmarshal(raw, &messageId); err != nil {
+		messageId = string(raw)
+	}
+	delete(payload, "messageId")
+	b, _ := json.Marshal(payload)
+	return messageId, string(b)
+}
+
+// publishEvseCommand hands the payload of a validated command to the publisher connection. The
+// main loop does not wait for the broker, a publish that fails later is logged, counted and
+// reported to failed from another goroutine.
+func publishEvseCommand(command string, deviceId string, message string, failed func(error)) error {
+	if evseCommandClient == nil || !evseCommandClient.IsConnectionOpen() {
+		return fmt.Errorf("no MQTT connection to publish commands")
+	}
+	topic := strings.NewReplacer("{deviceId}", deviceId, "{command}", command).Replace(evseCommandTopic)
+
+	token := evseCommandClient.Publish(topic, evseCommandQos, false, message)
+	go func() {
+		var err error
+		if !token.WaitTimeout(evseCommandTimeout) {
+			err = fmt.Errorf("publishing to %s timed out", topic)
+		} else if token.Error() != nil {
+			err = fmt.Errorf("publishing to %s: %w", topic, token.Error())
+		}
+		if err != nil {
+			evseCommandsFailed.Add(1)
+			fmt.Printf("\nEVSE command %s to %s failed: %v", command, deviceId, err)
+			failed(err)
+			return
+		}
+		fmt.Printf("\nEVSE command %s published to %s", command, topic)
+	}()
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeCommandClient records the publishes of the commands, the other methods are not used.
+type fakeCommandClient struct {
+	MQTT.Client
+	mu        sync.Mutex
+	published []string
+	err       error // of every publish when set
+}
+
+func (c *fakeCommandClient) IsConnectionOpen() bool { return true }
+
+func (c *fakeCommandClient) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published = append(c.published, topic+" "+payload.(string))
+	if c.err != nil {
+		return &failedToken{err: c.err}
+	}
+	return &MQTT.DummyToken{}
+}
+
+// failedToken is a publish the broker refused.
+type failedToken struct {
+	MQTT.DummyToken
+	err error
+}
+
+func (t *failedToken) Error() error { return t.err }
+
+func TestEvseCommandFailed(t *testing.T) {
+	evseCommandClient = &fakeCommandClient{err: errors.New("not authorized")}
+	setupChargerSchema(t)
+	t.Cleanup(func() { evseCommandClient = nil })
+
+	record := parseEvseCommand("IMT", "Reset", "EVSE", "cp-01", "backend", `{"messageId": "m1", "type": "Soft"}`)
+	if !strings.Contains(record, ",status=forwarded ") {
+		t.Fatalf("want status forwarded in %s", record)
+	}
+
+	select {
+	case failed := <-evseCommandResults:
+		for _, want := range []string{"Reset,deviceId=cp-01,", ",status=failed ", `messageId="m1"`, `type="Soft"`, "not authorized"} {
+			if !strings.Contains(failed, want) {
+				t.Errorf("no %s in %s", want, failed)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no failed record")
+	}
+}
+
+func TestEvseCommandDuplicates(t *testing.T) {
+	client := &fakeCommandClient{}
+	evseCommandClient, evseCommandDedup = client, newDedupCache(time.Minute)
+	setupChargerSchema(t)
+	t.Cleanup(func() { evseCommandClient, evseCommandDedup = nil, nil })
+
+	tests := []struct {
+		name    string
+		message string
+		status  string
+	}{
+		{"first", `{"messageId": "m1", "type": "Soft"}`, "forwarded"},
+		{"redelivered", `{"messageId": "m1", "type": "Soft"}`, "duplicate"},
+		{"new messageId", `{"messageId": "m2", "type": "Soft"}`, "forwarded"},
+		{"without messageId", `{"type": "Hard"}`, "forwarded"},
+		// An operator repeating a command without messageId means it
+		{"same payload without messageId", `{"type": "Hard"}`, "forwarded"},
+	}
+	for _, tt := range tests {
+		record := parseEvseCommand("IMT", "Reset", "EVSE", "cp-01", "backend", tt.message)
+		if !strings.Contains(record, ",status="+tt.status+" ") {
+			t.Errorf("%s: want status %s in %s", tt.name, tt.status, record)
+		}
+	}
+
+	want := []string{
+		`ocpp/cp-01/Reset {"type":"Soft"}`,
+		`ocpp/cp-01/Reset {"type":"Soft"}`,
+		`ocpp/cp-01/Reset {"type": "Hard"}`,
+		`ocpp/cp-01/Reset {"type": "Hard"}`,
+	}
+	if strings.Join(client.published, "\n") != strings.Join(want, "\n") {
+		t.Errorf("published %q, want %q", client.published, want)
+	}
+}
+
+func TestEvseCommandOrganization(t *testing.T) {
+	client := &fakeCommandClient{}
+	evseCommandClient = client
+	setupChargerSchema(t)
+	t.Cleanup(func() { evseCommandClient = nil })
+
+	tests := []struct {
+		organization string
+		deviceId     string
+		status       string
+	}{
+		{"IMT", "cp-01", "forwarded"},
+		{"SaoRafael", "cp-01", "rejected"},
+		{"IMT", "cp-02", "rejected"},
+	}
+	for _, tt := range tests {
+		record := parseEvseCommand(tt.organization, "UnlockConnector", "EVSE", tt.deviceId, "backend", `{"connectorId": 1}`)
+		if !strings.Contains(record, ",status="+tt.status+" ") {
+			t.Errorf("%s of %s: want status %s in %s", tt.deviceId, tt.organization, tt.status, record)
+		}
+	}
+	if len(client.published) != 1 {
+		t.Errorf("published %q, want only the command of IMT", client.published)
+	}
+}
+
+// setupChargerSchema registers charger cp-01 in organization IMT.
+func setupChargerSchema(t *testing.T) {
+	saved := schema
+	t.Cleanup(func() { schema = saved })
+	schema = Schema{Organizations: []SchemaOrganization{{
+		OrganizationName: "IMT",
+		Applications: []SchemaApplication{{
+			Devices: []SchemaDevice{{DeviceId: "cp-01", DeviceType: "EVSE"}},
+		}},
+	}}}
+}
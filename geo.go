@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Geofence is an area given as a polygon of [latitude, longitude] points, e.g.
+// {"name": "hospital", "measurement": "Tracking", "polygon": [[-23.64, -46.57], [-23.64, -46.56], [-23.65, -46.56]]}
+type Geofence struct {
+	Name        string       `json:"name"`
+	Measurement string       `json:"measurement"` // every measurement with positions when empty
+	DeviceId    string       `json:"device_id"`   // every device when empty
+	Polygon     [][2]float64 `json:"polygon"`
+}
+
+// Position is the last fix of a device.
+type Position struct {
+	Latitude  float64
+	Longitude float64
+	Timestamp int64
+}
+
+// positions is keyed by deviceType/deviceId and only touched from the main loop goroutine.
+var positions = make(map[string]*Position)
+
+// geofenceStates tells whether a device is inside a geofence, keyed by geofence name/deviceId.
+var geofenceStates = make(map[string]bool)
+
+const earthRadius = 6371008.8 // mean radius in meters
+
+// validCoordinate reports whether lat and lon are a position. 0, 0 is what the devices send
+// before their first fix.
+func validCoordinate(lat float64, lon float64) bool {
+	if math.IsNaN(lat) || math.IsNaN(lon) || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return false
+	}
+	return lat != 0 || lon != 0
+}
+
+// haversine is the great circle distance in meters between two positions.
+func haversine(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	phi1 := lat1 * math.Pi / 180
+	phi2 := lat2 * math.Pi / 180
+	dPhi := (lat2 - lat1) * math.Pi / 180
+	dLambda := (lon2 - lon1) * math.Pi / 180
+
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLambda/2)*math.Sin(dLambda/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// enrichPosition checks the latField and lonField of a parsed message. Without a valid fix both
+// fields are removed and gpsFix=false is added. With one, gpsFix=true is added along with the
+// distance in meters and speed in km/h from the previous fix of the device, and the geofences
+// are checked.
+func enrichPosition(message string, latField string, lonField string, deviceType string, etc string, now time.Time) string {
+	line, ok := parseLine(message)
+	if !ok {
+		return message
+	}
+	lat, okLat := fieldFloat(line.Fields[latField])
+	lon, okLon := fieldFloat(line.Fields[lonField])
+	if !okLat && !okLon {
+		return message
+	}
+
+	if !okLat || !okLon || !validCoordinate(lat, lon) {
+		delete(line.Fields, latField)
+		delete(line.Fields, lonField)
+		setField(&line, "gpsFix", "false")
+		if len(line.Fields) == 0 {
+			return ""
+		}
+		return formatLine(line)
+	}
+	setField(&line, "gpsFix", "true")
+
+	deviceId := line.Tags["deviceId"]
+	timestamp := line.Timestamp
+	if timestamp == 0 {
+		timestamp = now.UnixNano()
+	}
+
+	key := deviceType + "/" + deviceId
+	previous, ok := positions[key]
+	if ok && timestamp > previous.Timestamp {
+		distance := haversine(previous.Latitude, previous.Longitude, lat, lon)
+		hours := time.Duration(timestamp - previous.Timestamp).Hours()
+		setField(&line, "distance", strconv.FormatFloat(roundFloat(distance, 1), 'f', -1, 64))
+		setField(&line, "speed", strconv.FormatFloat(roundFloat(distance/1000/hours, 1), 'f', -1, 64))
+	}
+	if !ok || timestamp > previous.Timestamp {
+		positions[key] = &Position{Latitude: lat, Longitude: lon, Timestamp: timestamp}
+	}
+
+	checkGeofences(line.Measurement, deviceType, deviceId, etc, lat, lon, timestamp)
+
+	return formatLine(line)
+}
+
+// setField sets a field of line, adding it after the others when missing.
+func setField(line *Line, key string, value string) {
+	if _, ok := line.Fields[key]; !ok {
+		line.FieldKeys = append(line.FieldKeys, key)
+	}
+	line.Fields[key] = value
+}
+
+// checkGeofences emits a GeofenceEvent record when a device enters or exits a geofence. The first
+// position of a device only sets where it is.
+func checkGeofences(measurement string, deviceType string, deviceId string, etc string, lat float64, lon float64, timestamp int64) {
+	for i := range schema.Geofences {
+		geofence := &schema.Geofences[i]
+		if (geofence.Measurement != "" && geofence.Measurement != measurement) || (geofence.DeviceId != "" && geofence.DeviceId != deviceId) {
+			continue
+		}
+
+		inside := geofence.contains(lat, lon)
+		key := geofence.Name + "/" + deviceId
+		wasInside, seen := geofenceStates[key]
+		geofenceStates[key] = inside
+		if !seen || wasInside == inside {
+			continue
+		}
+
+		event := "exit"
+		if inside {
+			event = "enter"
+		}
+		emitRecord(geofenceEvent(geofence.Name, event, deviceType, deviceId, etc, lat, lon, timestamp))
+		fmt.Printf("\nDevice %s %s geofence %s", deviceId, event, geofence.Name)
+	}
+}
+
+// contains tests the position against the polygon by ray casting, treating latitude and
+// longitude as plane coordinates, which holds for areas of a few kilometers.
+func (g *Geofence) contains(lat float64, lon float64) bool {
+	inside := false
+	n := len(g.Polygon)
+	for i, j := 0, n-1; i < n; j, i = i, i+1 {
+		lat1, lon1 := g.Polygon[i][0], g.Polygon[i][1]
+		lat2, lon2 := g.Polygon[j][0], g.Polygon[j][1]
+		if (lat1 > lat) != (lat2 > lat) && lon < (lon2-lon1)*(lat-lat1)/(lat2-lat1)+lon1 {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// geofenceEvent formats a geofence crossing as
+// GeofenceEvent,deviceId=,deviceType=,direction=event,origin=,geofence=,event= latitude=,longitude= timestamp
+func geofenceEvent(name string, event string, deviceType string, deviceId string, etc string, lat float64, lon float64, timestamp int64) string {
+	var sb strings.Builder
+
+	sb.WriteString(`GeofenceEvent`)
+
+	// Tags
+	sb.WriteString(`,deviceId=`)
+	sb.WriteString(deviceId)
+	sb.WriteString(`,deviceType=`)
+	sb.WriteString(deviceType)
+	sb.WriteString(`,direction=event`)
+	sb.WriteString(`,origin=`)
+	sb.WriteString(etc)
+	sb.WriteString(`,geofence=`)
+	sb.WriteString(tagValueEscaper.Replace(name))
+	sb.WriteString(`,event=`)
+	sb.WriteString(event)
+
+	// Fields
+	sb.WriteString(` `)
+	sb.WriteString(`latitude=`)
+	sb.WriteString(strconv.FormatFloat(lat, 'f', -1, 64))
+	sb.WriteString(`,longitude=`)
+	sb.WriteString(strconv.FormatFloat(lon, 'f', -1, 64))
+
+	// Timestamp_ns
+	sb.WriteString(` `)
+	sb.WriteString(strconv.FormatInt(timestamp, 10))
+
+	return sb.String()
+}
+
+func validateGeofences(geofences []Geofence) error {
+	for _, geofence := range geofences {
+		if geofence.Name == "" {
+			return fmt.Errorf("geofence needs a name")
+		}
+		if len(geofence.Polygon) < 3 {
+			return fmt.Errorf("geofence %q needs at least 3 points", geofence.Name)
+		}
+		for _, point := range geofence.Polygon {
+			if !validCoordinate(point[0], point[1]) {
+				return fmt.Errorf("geofence %q has invalid point %v", geofence.Name, point)
+			}
+		}
+	}
+	return nil
+}
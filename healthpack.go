@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HealthPackField is a data key of a HealthPack measurement and the line protocol type it is
+// written as. Sample is a value seen in the uplinks, checked against Type at startup.
+type HealthPackField struct {
+	Key    string
+	Type   string // float, int or bool
+	Sample string
+}
+
+// healthPackSchema lists the fields of each HealthPack measurement in the order they are written.
+var healthPackSchema = map[string][]HealthPackField{
+	"Inertias": {
+		{"fAccX", "float", "0.0"},
+		{"fAccY", "float", "0.0"},
+		{"fAccZ", "float", "0.0"},
+		{"accX", "float", "944.000000"},
+		{"accY", "float", "-356.000000"},
+		{"accZ", "float", "-16960.000000"},
+		{"gyrX", "float", "-491.000000"},
+		{"gyrY", "float", "15.000000"},
+		{"gyrZ", "float", "196.000000"},
+		{"contimpactoX", "float", "944.000000"},
+		{"contimpactoY", "float", "412.000000"},
+		{"contimpactoZ", "float", "17968.000000"},
+		{"pitch", "float", "-1.200725"},
+		{"roll", "float", "-3.185352"},
+		{"yaw", "float", "0.000000"},
+	},
+	"Tracking": {
+		{"latitude", "float", "0.000000"},
+		{"longitude", "float", "0.000000"},
+		{"tempbateriasecundaria", "float", "24.2"},
+		{"tempbateriaprincipal", "float", "23.6"},
+		{"temperaturacondensador", "float", "28.1"},
+		{"temperaturacuba1", "float", "-0.9"},
+		{"temperaturacuba2", "float", "11.4"},
+		{"temperaturaexternaLL", "float", "36.3"},
+		{"temperaturaexternaLS", "float", "8.4"},
+		{"temperaturaexterna", "float", "28.1"},
+		{"temperaturadissipador", "float", "26.5"},
+		{"correntebateria", "float", "0.0"},
+		{"correntecompressor", "float", "3.9"},
+		{"correntepeltier", "float", "0.0"},
+		{"correntecooler", "float", "0.0"},
+		{"correnteexaustor", "float", "0.0"},
+		{"temperaturacompressor", "float", "44.8"},
+		{"setpoint_pid1", "float", "-5.0"},
+		{"valor_pid1_atual", "float", "-0.9"},
+		{"esforco_pid1", "float", "536.0"},
+		{"setpoint_pid2", "float", "50.0"},
+		{"valor_pid2_atual", "float", "44.8"},
+		{"esforco_pid2", "float", "0.0"},
+	},
+	"Status": {
+		{"vbateriaprincipal", "float", "21.8"},
+		{"vbateriasecundaria", "float", "4.2"},
+		{"ventradafonteexterna", "float", "21.8"},
+		{"numerocaixa", "int", "0.0"},
+		{"estadomaquina", "int", "53.0"},
+		{"timestamp", "int", "0.0"},
+		{"idFalha", "int", "0.0"},
+		{"porcentagemsinalcomunicacao", "float", "0.0"},
+		{"fatorRH", "float", "0.0"},
+		{"btdown", "bool", "0.0"},
+		{"btselect", "bool", "0.0"},
+		{"btup", "bool", "0.0"},
+		{"tecla_enter", "bool", "0.0"},
+		{"statustampaprincipal", "int", "1.0"},
+		{"statusserialprincipal", "int", "0.0"},
+		{"statusserialsecundaria", "int", "0.0"},
+		{"statustampacasamaq", "int", "0.0"},
+		{"controle_peltier", "float", "0.0"},
+		{"porcentagem_bat", "float", "100.0"},
+	},
+}
+
+// healthPackFields writes the data of a HealthPack measurement as " key=value,..." with the
+// types of healthPackSchema. Missing, empty or invalid values are left out, and it returns ""
+// when no value is left.
+func healthPackFields(measurement string, data map[string]interface{}) string {
+	var sb strings.Builder
+
+	for _, field := range healthPackSchema[measurement] {
+		raw, ok := data[field.Key]
+		if !ok {
+			continue
+		}
+		value, ok := healthPackValue(raw, field.Type)
+		if !ok {
+			if raw != "" && raw != nil {
+				fmt.Printf("\nInvalid %s value %v for %s in HealthPackMeasurement - %s", field.Type, raw, field.Key, measurement)
+			}
+			continue
+		}
+
+		if sb.Len() == 0 {
+			sb.WriteString(` `)
+		} else {
+			sb.WriteString(`,`)
+		}
+		sb.WriteString(field.Key)
+		sb.WriteString(`=`)
+		sb.WriteString(value)
+	}
+
+	return sb.String()
+}
+
+// healthPackValue formats a data value, sent as a string such as "53.0" or as a JSON number or
+// boolean, as a line protocol value of the given type.
+func healthPackValue(raw interface{}, fieldType string) (string, bool) {
+	var f float64
+
+	switch v := raw.(type) {
+	case string:
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return "", false
+		}
+		if b, err := strconv.ParseBool(v); err == nil {
+			f = 0
+			if b {
+				f = 1
+			}
+			break
+		}
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return "", false
+		}
+		f = parsed
+	case float64:
+		f = v
+	case bool:
+		if fieldType == "bool" {
+			return strconv.FormatBool(v), true
+		}
+		return "", false
+	default:
+		return "", false
+	}
+
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", false
+	}
+
+	switch fieldType {
+	case "float":
+		return strconv.FormatFloat(f, 'f', -1, 64), true
+	case "int":
+		if f != math.Trunc(f) {
+			return "", false
+		}
+		return strconv.FormatInt(int64(f), 10) + "i", true
+	case "bool":
+		return strconv.FormatBool(f != 0), true
+	}
+	return "", false
+}
+
+// validateHealthPackSchema checks that every sample value parses as the type of its field.
+func validateHealthPackSchema() error {
+	for measurement, fields := range healthPackSchema {
+		for _, field := range fields {
+			if _, ok := healthPackValue(field.Sample, field.Type); !ok {
+				return fmt.Errorf("HealthPack %s field %s: sample %q is not a valid %s", measurement, field.Key, field.Sample, field.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// kafkaAlarmTopic, when set, also receives the Alarm records and their alerts.
+var kafkaAlarmTopic string
+
+var fieldKeyEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+
+var fieldKeyUnescaper = strings.NewReplacer(`\,`, `,`, `\=`, `=`, `\ `, ` `)
+
+var fieldStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// healthPackAlarmFields writes every alarm of an Alarm uplink as a field. The alarms are read
+// from data.alarms, or from the healthpack_alarm_keys of the schema when it has no alarms object.
+// Flags, sent as booleans, 0/1 numbers or their text, become booleans and any other text is kept
+// as a string. Other numbers are not flags and are left out.
+func healthPackAlarmFields(data map[string]interface{}) string {
+	var sb strings.Builder
+	var healthPackAlarm HealthPackAlarm
+
+	if alarms, ok := data["alarms"].(map[string]interface{}); ok {
+		healthPackAlarm.Alarms = alarms
+	} else {
+		healthPackAlarm.Alarms = make(map[string]interface{})
+		for _, key := range schema.HealthPackAlarmKeys {
+			if raw, ok := data[key]; ok {
+				healthPackAlarm.Alarms[key] = raw
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(healthPackAlarm.Alarms))
+	for key := range healthPackAlarm.Alarms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		raw := healthPackAlarm.Alarms[key]
+
+		var value string
+		if active, ok := healthPackAlarmFlag(raw); ok {
+			value = strconv.FormatBool(active)
+		} else if text, isText := raw.(string); isText && strings.TrimSpace(text) != "" {
+			value = `"` + fieldStringEscaper.Replace(strings.TrimSpace(text)) + `"`
+		} else {
+			if raw != nil {
+				fmt.Printf("\nInvalid alarm value %v for %s in HealthPackMeasurement - Alarm", raw, key)
+			}
+			continue
+		}
+
+		if sb.Len() == 0 {
+			sb.WriteString(` `)
+		} else {
+			sb.WriteString(`,`)
+		}
+		sb.WriteString(fieldKeyEscaper.Replace(key))
+		sb.WriteString(`=`)
+		sb.WriteString(value)
+	}
+
+	return sb.String()
+}
+
+// healthPackAlarmFlag reads an alarm flag sent as a boolean, as 0 or 1, or as the text of either.
+func healthPackAlarmFlag(raw interface{}) (active bool, ok bool) {
+	switch v := raw.(type) {
+	case bool:
+		return v, true
+	case float64:
+		if v == 0 || v == 1 {
+			return v == 1, true
+		}
+	case string:
+		v = strings.TrimSpace(v)
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b, true
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil && (f == 0 || f == 1) {
+			return f == 1, true
+		}
+	}
+	return false, false
+}
+
+// healthPackAlarmStates holds the active alarms by deviceId and alarm key. It is only touched
+// from the main loop goroutine.
+var healthPackAlarmStates = make(map[string]map[string]bool)
+
+// emitHealthPackAlarms emits an alert for every alarm of a parsed Alarm record that turned active,
+// and forwards the record and its alerts to kafkaAlarmTopic. An alarm that stays active raises no
+// new alert until it has been cleared by a false flag. alarms are the fields written by
+// healthPackAlarmFields, the ones the gateway adds such as clockSkew are not alarms, and text
+// values neither raise nor clear an alarm.
+func emitHealthPackAlarms(message string, alarms string, deviceType string, etc string, now time.Time) {
+	line, ok := parseLine(message)
+	if !ok {
+		return
+	}
+	deviceId := line.Tags["deviceId"]
+
+	if kafkaAlarmTopic != "" {
+		emitRecordTo(kafkaAlarmTopic, message)
+	}
+
+	active, ok := healthPackAlarmStates[deviceId]
+	if !ok {
+		active = make(map[string]bool)
+		healthPackAlarmStates[deviceId] = active
+	}
+
+	for _, field := range splitUnquoted(strings.TrimPrefix(alarms, " "), ',') {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		name := fieldKeyUnescaper.Replace(key)
+
+		switch value {
+		case "false":
+			delete(active, name)
+			continue
+		case "true":
+			if active[name] {
+				continue
+			}
+			active[name] = true
+		default:
+			continue
+		}
+
+		var alert Alert
+		alert.DeviceId = deviceId
+		alert.DeviceType = deviceType
+		alert.Etc = etc
+		alert.Data = fieldStringEscaper.Replace(name)
+		alert.Timestamp = line.Timestamp
+		if alert.Timestamp == 0 {
+			alert.Timestamp = now.UnixNano()
+		}
+		alert.Trigger = fieldStringEscaper.Replace(name)
+		alert.TriggerAt = now.Format(time.RFC3339)
+		alert.TriggerType = "alarm"
+		alert.ActionSensor = fieldStringEscaper.Replace(name)
+		alert.CurrentValue = value
+
+		record := formatAlert(line.Measurement, deviceType, deviceId, etc, alert)
+		emitRecord(record)
+		if kafkaAlarmTopic != "" {
+			emitRecordTo(kafkaAlarmTopic, record)
+		}
+	}
+}
+
+var (
+	// Time zone of the HealthPack dates when neither the device nor its organization has one
+	healthPackTimeZone = "America/Sao_Paulo"
+	// Dates further than healthPackMaxClockSkew from the receive time are replaced by it
+	healthPackMaxClockSkew = time.Hour
+)
+
+// healthPackTime reads a HealthPack date such as "24:12:09 16:18:53" in the time zone of the
+// device. It falls back to the receive time when the date cannot be parsed or is further than
+// healthPackMaxClockSkew from it, and reports which source was used. skew is the receive time
+// minus the device time, only valid when parsed is true.
+func healthPackTime(date string, location *time.Location, received time.Time) (t time.Time, source string, skew time.Duration, parsed bool) {
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", "20"+strings.TrimSpace(date), location)
+	if err != nil {
+		fmt.Printf("\nError parsing date %q, using the receive time: %v", date, err)
+		healthPackClockInvalid.Add(1)
+		return received, "gateway", 0, false
+	}
+
+	skew = received.Sub(t)
+	if skew > healthPackMaxClockSkew || skew < -healthPackMaxClockSkew {
+		fmt.Printf("\nDevice clock skewed by %s, using the receive time", skew.Round(time.Second))
+		healthPackClockInvalid.Add(1)
+		return received, "gateway", skew, true
+	}
+	return t, "device", skew, true
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthPackAlarmsIgnoreGatewayFields(t *testing.T) {
+	t.Cleanup(func() {
+		pendingRecords = pendingRecords[:0]
+		delete(healthPackAlarmStates, "HP01")
+	})
+	pendingRecords = pendingRecords[:0]
+
+	// A device clock in time gives a clockSkew field next to the alarms
+	date := time.Now().In(time.UTC).Format("06:01:02 15:04:05")
+	message := `{"props": {"deviceName": "HP01"}, "date": "` + date + `", "data": {"alarms": {"tampa aberta": true, "bateria": false}}}`
+
+	record := parseHealthPack("IMT", "Alarm", "HealthPack", "0001", "up", "imt", message)
+	if !strings.Contains(record, ",clockSkew=") {
+		t.Fatalf("no clockSkew in %s", record)
+	}
+
+	var alerts []string
+	for _, pending := range pendingRecords {
+		alerts = append(alerts, pending.Value)
+	}
+	if len(alerts) != 1 || !strings.Contains(alerts[0], `trigger="tampa aberta"`) {
+		t.Fatalf("want one tampa aberta alert, got %q", alerts)
+	}
+}
+
+func TestHealthPackAlarms(t *testing.T) {
+	alarmKeys := schema.HealthPackAlarmKeys
+	schema.HealthPackAlarmKeys = []string{"tampa"}
+	t.Cleanup(func() {
+		schema.HealthPackAlarmKeys = alarmKeys
+		pendingRecords = pendingRecords[:0]
+		delete(healthPackAlarmStates, "HP01")
+	})
+
+	uplinks := []struct {
+		data   string
+		fields string
+		alerts []string
+	}{
+		// Only the configured keys of data are alarms
+		{`{"tampa": 1, "timestamp": 1733760000, "porcentagem_bat": 87.5, "numerocaixa": 3}`, ` tampa=true`, []string{"tampa"}},
+		// An alarm that stays active does not alert again
+		{`{"tampa": "1"}`, ` tampa=true`, nil},
+		{`{"tampa": 0}`, ` tampa=false`, nil},
+		{`{"tampa": true}`, ` tampa=true`, []string{"tampa"}},
+		// Text and numbers other than 0/1 are not flags
+		{`{"alarms": {"bateria": "OK", "porta": "normal", "nivel": 2, "tampa": true}}`, ` bateria="OK",porta="normal",tampa=true`, nil},
+		{`{"alarms": {"porta": "true"}}`, ` porta=true`, []string{"porta"}},
+	}
+
+	for i, uplink := range uplinks {
+		pendingRecords = pendingRecords[:0]
+		message := `{"props": {"deviceName": "HP01"}, "date": "", "data": ` + uplink.data + `}`
+
+		record := parseHealthPack("IMT", "Alarm", "HealthPack", "0001", "up", "imt", message)
+		if !strings.Contains(record, uplink.fields+" ") {
+			t.Errorf("uplink %d: want fields %q in %s", i, uplink.fields, record)
+		}
+
+		var alerts []string
+		for _, pending := range pendingRecords {
+			line, ok := parseLine(pending.Value)
+			if !ok {
+				t.Fatalf("uplink %d: invalid alert %s", i, pending.Value)
+			}
+			alerts = append(alerts, strings.Trim(line.Fields["trigger"], `"`))
+		}
+		if strings.Join(alerts, ",") != strings.Join(uplink.alerts, ",") {
+			t.Errorf("uplink %d: got alerts %q, want %q", i, alerts, uplink.alerts)
+		}
+	}
+}
+
+// TestHealthPackFixtures decodes the uplinks of testdata/healthpack, named after their measurement,
+// and compares the records with the .line file next to them. clockSkew depends on the time the
+// test runs and is left out of the comparison.
+func TestHealthPackFixtures(t *testing.T) {
+	maxClockSkew := healthPackMaxClockSkew
+	healthPackMaxClockSkew = 100 * 365 * 24 * time.Hour
+	t.Cleanup(func() {
+		healthPackMaxClockSkew = maxClockSkew
+		pendingRecords = pendingRecords[:0]
+	})
+
+	payloads, err := filepath.Glob("testdata/healthpack/*.json")
+	if err != nil || len(payloads) == 0 {
+		t.Fatalf("no fixtures: %v", err)
+	}
+	clockSkew := regexp.MustCompile(`,clockSkew=[^ ,]+`)
+
+	for _, payload := range payloads {
+		name := strings.TrimSuffix(filepath.Base(payload), ".json")
+		t.Run(name, func(t *testing.T) {
+			message, err := os.ReadFile(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := os.ReadFile(strings.TrimSuffix(payload, ".json") + ".line")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			measurement, _, _ := strings.Cut(name, "_")
+			record := parseHealthPack("SaoRafael", measurement, "HealthPack", "0001", "up", "imt", string(message))
+			if got := clockSkew.ReplaceAllString(record, ""); got != strings.TrimSpace(string(want)) {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HealthPackCode is a coded Status field written as a named tag besides its numeric field, and
+// whose changes are StateTransition records with Tag as variable.
+type HealthPackCode struct {
+	Field  string
+	Tag    string
+	Button bool // only tracked for transitions, a press is too short lived for a tag
+}
+
+var healthPackCodes = []HealthPackCode{
+	{Field: "estadomaquina", Tag: "state"},
+	{Field: "idFalha", Tag: "fault"},
+	{Field: "statustampaprincipal", Tag: "lid"},
+	{Field: "statustampacasamaq", Tag: "machineLid"},
+	{Field: "btup", Tag: "buttonUp", Button: true},
+	{Field: "btdown", Tag: "buttonDown", Button: true},
+	{Field: "btselect", Tag: "buttonSelect", Button: true},
+	{Field: "tecla_enter", Tag: "buttonEnter", Button: true},
+}
+
+// defaultHealthPackCodeNames name the codes by field, healthpack_codes of the schema adds or
+// replaces names. Only the lids, the buttons and the absence of a fault are known here: the
+// machine states and faults depend on the firmware of the box and come from healthpack_codes.
+// Codes without a name are written as the number.
+var defaultHealthPackCodeNames = map[string]map[string]string{
+	"idFalha":              {"0": "none"},
+	"statustampaprincipal": {"0": "open", "1": "closed"},
+	"statustampacasamaq":   {"0": "open", "1": "closed"},
+	"btup":                 {"0": "released", "1": "pressed"},
+	"btdown":               {"0": "released", "1": "pressed"},
+	"btselect":             {"0": "released", "1": "pressed"},
+	"tecla_enter":          {"0": "released", "1": "pressed"},
+}
+
+// unnamedHealthPackCodes remembers the field/code pairs already reported without a name.
+var unnamedHealthPackCodes = make(map[string]bool)
+
+// HealthPackState is the last decoded Status of a transport box.
+type HealthPackState struct {
+	Codes map[string]int64 // by field
+}
+
+// healthPackStates is keyed by deviceId and only touched from the main loop goroutine.
+var healthPackStates = make(map[string]*HealthPackState)
+
+// healthPackCodeName returns the name of a code of field.
+func healthPackCodeName(field string, code int64) string {
+	key := strconv.FormatInt(code, 10)
+	if name, ok := schema.HealthPackCodes[field][key]; ok {
+		return name
+	}
+	if name, ok := defaultHealthPackCodeNames[field][key]; ok {
+		return name
+	}
+	if !unnamedHealthPackCodes[field+"/"+key] {
+		unnamedHealthPackCodes[field+"/"+key] = true
+		fmt.Printf("\nHealthPack %s code %s has no name in healthpack_codes", field, key)
+	}
+	return key
+}
+
+// validateHealthPackCodes checks that healthpack_codes names integer codes of the coded Status
+// fields, and that the transport states are named machine states.
+func validateHealthPackCodes(s Schema) error {
+	for field, names := range s.HealthPackCodes {
+		known := false
+		for _, code := range healthPackCodes {
+			known = known || code.Field == field
+		}
+		if !known {
+			return fmt.Errorf("healthpack_codes: %s is not a coded Status field", field)
+		}
+		for key, name := range names {
+			if _, err := strconv.ParseInt(key, 10, 64); err != nil {
+				return fmt.Errorf("healthpack_codes: %s code %q is not an integer", field, key)
+			}
+			if name == "" {
+				return fmt.Errorf("healthpack_codes: %s code %s has an empty name", field, key)
+			}
+		}
+	}
+	for _, state := range s.HealthPackTransportStates {
+		if _, ok := s.HealthPackCodes["estadomaquina"][strconv.FormatInt(state, 10)]; !ok {
+			return fmt.Errorf("healthpack_transport_states: %d is not named in healthpack_codes.estadomaquina", state)
+		}
+	}
+	return nil
+}
+
+// checkHealthPackCodes reports at startup the firmware codes the schema leaves without names.
+func checkHealthPackCodes() {
+	for _, field := range []string{"estadomaquina", "idFalha"} {
+		if len(schema.HealthPackCodes[field]) == 0 {
+			fmt.Printf("HealthPack %s has no names in healthpack_codes of SCHEMA_FILE, its codes are written as numbers\n", field)
+		}
+	}
+	if len(schema.HealthPackTransportStates) == 0 {
+		fmt.Println("HealthPack healthpack_transport_states is not set, lid and fault alerts are only raised while the ischemia timer runs")
+	}
+}
+
+// healthPackStatusTags writes the named codes of a Status uplink as tags.
+func healthPackStatusTags(data map[string]interface{}) string {
+	var sb strings.Builder
+
+	for _, code := range healthPackCodes {
+		if code.Button {
+			continue
+		}
+		value, ok := healthPackCode(data[code.Field])
+		if !ok {
+			continue
+		}
+		sb.WriteString(`,`)
+		sb.WriteString(code.Tag)
+		sb.WriteString(`=`)
+		sb.WriteString(tagValueEscaper.Replace(healthPackCodeName(code.Field, value)))
+	}
+
+	return sb.String()
+}
+
+func healthPackCode(raw interface{}) (int64, bool) {
+	value, ok := healthPackValue(raw, "int")
+	if !ok {
+		return 0, false
+	}
+	code, err := strconv.ParseInt(strings.TrimSuffix(value, "i"), 10, 64)
+	return code, err == nil
+}
+
+// trackHealthPackState compares the codes and buttons of a parsed Status record with the previous
+// ones of the device and emits a StateTransition record for every change. A lid opened or a fault raised while
+// the box is transporting an organ is also emitted as an alert.
+func trackHealthPackState(message string, deviceType string, etc string, now time.Time) {
+	line, ok := parseLine(message)
+	if !ok {
+		return
+	}
+	deviceId := line.Tags["deviceId"]
+	timestamp := line.Timestamp
+	if timestamp == 0 {
+		timestamp = now.UnixNano()
+	}
+
+	state, ok := healthPackStates[deviceId]
+	if !ok {
+		state = &HealthPackState{Codes: make(map[string]int64)}
+		healthPackStates[deviceId] = state
+	}
+
+	for _, code := range healthPackCodes {
+		value, ok := fieldFloat(line.Fields[code.Field])
+		if !ok {
+			continue
+		}
+		to := int64(value)
+		from, seen := state.Codes[code.Field]
+		state.Codes[code.Field] = to
+		if !seen || from == to {
+			continue
+		}
+
+		emitRecord(healthPackTransition(deviceId, deviceType, etc, code, from, to, timestamp))
+
+		if !healthPackTransporting(deviceId, state) {
+			continue
+		}
+		switch {
+		case code.Tag == "lid" && healthPackCodeName(code.Field, to) == "open":
+			emitHealthPackStateAlert(line.Measurement, deviceId, deviceType, etc, code, to, "lid opened during transport", timestamp, now)
+		case code.Tag == "fault" && healthPackCodeName(code.Field, to) != "none":
+			emitHealthPackStateAlert(line.Measurement, deviceId, deviceType, etc, code, to, "fault during transport", timestamp, now)
+		}
+	}
+}
+
+// healthPackTransporting reports whether the box carries an organ: its ischemia timer is running
+// or its machine state is one of healthpack_transport_states.
+func healthPackTransporting(deviceId string, state *HealthPackState) bool {
+	if ischemia, ok := ischemiaStates[deviceId]; ok && ischemia.Running {
+		return true
+	}
+	if code, ok := state.Codes["estadomaquina"]; ok {
+		for _, transport := range schema.HealthPackTransportStates {
+			if code == transport {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// healthPackTransition formats a code change as
+// StateTransition,deviceId=,deviceType=,direction=event,origin=,variable= from=,to=,fromCode=,toCode= timestamp
+func healthPackTransition(deviceId string, deviceType string, etc string, code HealthPackCode, from int64, to int64, timestamp int64) string {
+	var sb strings.Builder
+
+	sb.WriteString(`StateTransition`)
+
+	// Tags
+	sb.WriteString(`,deviceId=`)
+	sb.WriteString(deviceId)
+	sb.WriteString(`,deviceType=`)
+	sb.WriteString(deviceType)
+	sb.WriteString(`,direction=event`)
+	sb.WriteString(`,origin=`)
+	sb.WriteString(etc)
+	sb.WriteString(`,variable=`)
+	sb.WriteString(code.Tag)
+
+	// Fields
+	sb.WriteString(` `)
+	sb.WriteString(`from="`)
+	sb.WriteString(fieldStringEscaper.Replace(healthPackCodeName(code.Field, from)))
+	sb.WriteString(`",to="`)
+	sb.WriteString(fieldStringEscaper.Replace(healthPackCodeName(code.Field, to)))
+	sb.WriteString(`",fromCode=`)
+	sb.WriteString(strconv.FormatInt(from, 10))
+	sb.WriteString(`i,toCode=`)
+	sb.WriteString(strconv.FormatInt(to, 10))
+	sb.WriteString(`i`)
+
+	// Timestamp_ns
+	sb.WriteString(` `)
+	sb.WriteString(strconv.FormatInt(timestamp, 10))
+
+	return sb.String()
+}
+
+// emitHealthPackStateAlert emits an alert for a code change, also to kafkaAlarmTopic when set.
+func emitHealthPackStateAlert(measurement string, deviceId string, deviceType string, etc string, code HealthPackCode, to int64, data string, timestamp int64, now time.Time) {
+	var alert Alert
+
+	alert.DeviceId = deviceId
+	alert.DeviceType = deviceType
+	alert.Etc = etc
+	alert.Data = data
+	alert.Timestamp = timestamp
+	alert.Trigger = code.Tag + " " + healthPackCodeName(code.Field, to)
+	alert.TriggerAt = now.Format(time.RFC3339)
+	alert.TriggerType = code.Tag
+	alert.ActionSensor = code.Field
+	alert.CurrentValue = strconv.FormatInt(to, 10)
+
+	record := formatAlert(measurement, deviceType, deviceId, etc, alert)
+	emitRecord(record)
+	if kafkaAlarmTopic != "" {
+		emitRecordTo(kafkaAlarmTopic, record)
+	}
+}
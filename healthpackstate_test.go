@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateHealthPackCodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema Schema
+		valid  bool
+	}{
+		{"named states", Schema{
+			HealthPackCodes:           map[string]map[string]string{"estadomaquina": {"53": "transport"}},
+			HealthPackTransportStates: []int64{53},
+		}, true},
+		{"unknown field", Schema{HealthPackCodes: map[string]map[string]string{"estado": {"53": "transport"}}}, false},
+		{"code not an integer", Schema{HealthPackCodes: map[string]map[string]string{"idFalha": {"53.0": "compressor"}}}, false},
+		{"empty name", Schema{HealthPackCodes: map[string]map[string]string{"idFalha": {"3": ""}}}, false},
+		{"unnamed transport state", Schema{HealthPackTransportStates: []int64{53}}, false},
+	}
+	for _, tt := range tests {
+		if err := validateHealthPackCodes(tt.schema); (err == nil) != tt.valid {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
+
+func TestHealthPackButtonTransitions(t *testing.T) {
+	t.Cleanup(func() {
+		pendingRecords = pendingRecords[:0]
+		delete(healthPackStates, "HP01")
+	})
+	pendingRecords = pendingRecords[:0]
+	delete(healthPackStates, "HP01")
+	now := time.Now()
+
+	trackHealthPackState(`Status,deviceId=HP01 btup=false,tecla_enter=false,statustampaprincipal=1i 1700000000000000000`, "HealthPack", "imt", now)
+	trackHealthPackState(`Status,deviceId=HP01 btup=true,tecla_enter=false,statustampaprincipal=1i 1700000060000000000`, "HealthPack", "imt", now)
+	trackHealthPackState(`Status,deviceId=HP01 btup=false,tecla_enter=false,statustampaprincipal=1i 1700000120000000000`, "HealthPack", "imt", now)
+
+	want := []string{
+		`StateTransition,deviceId=HP01,deviceType=HealthPack,direction=event,origin=imt,variable=buttonUp from="released",to="pressed",fromCode=0i,toCode=1i 1700000060000000000`,
+		`StateTransition,deviceId=HP01,deviceType=HealthPack,direction=event,origin=imt,variable=buttonUp from="pressed",to="released",fromCode=1i,toCode=0i 1700000120000000000`,
+	}
+	var got []string
+	for _, pending := range pendingRecords {
+		got = append(got, pending.Value)
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
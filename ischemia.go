@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultIschemiaThresholds is the remaining ischemia time below which an alert is raised, by organ.
+// "*" applies to the organs missing in the table, ischemia_thresholds of the schema overrides it.
+var defaultIschemiaThresholds = map[string]time.Duration{
+	"coracao":          time.Hour,
+	"pulmao":           time.Hour,
+	"figado":           2 * time.Hour,
+	"pancreas":         2 * time.Hour,
+	"rim":              4 * time.Hour,
+	"tecidos_oculares": 12 * time.Hour,
+	"*":                time.Hour,
+}
+
+type IschemiaState struct {
+	Running bool // the box reports ischemia time, i.e. it is transporting an organ
+	Low     bool // remaining time below the organ threshold
+	Expired bool // remaining time reached zero
+}
+
+// ischemiaStates is keyed by deviceId and only touched from the main loop goroutine.
+var ischemiaStates = make(map[string]*IschemiaState)
+
+var tagValueEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+
+// healthPackIschemiaFields writes orgao and numtransplante as tags, followed by the ischemia
+// times in seconds and the remaining values as string fields. It returns "" when no field is left.
+func healthPackIschemiaFields(data map[string]interface{}) string {
+	var sb strings.Builder
+	var fields strings.Builder
+	var healthPackIschemia HealthPackIschemia
+
+	healthPackIschemia.IdModal = healthPackString(data, "idModal")
+	healthPackIschemia.IdOperador = healthPackString(data, "IdOperador")
+	healthPackIschemia.Niveldepermissao = healthPackString(data, "niveldepermissao")
+	healthPackIschemia.Nome = healthPackString(data, "nome")
+	healthPackIschemia.Numtransplante = healthPackString(data, "numtransplante")
+	healthPackIschemia.Numeroempresa = healthPackString(data, "numeroempresa")
+	healthPackIschemia.Orgao = healthPackString(data, "orgao")
+	healthPackIschemia.Tempo_total_isquemia = healthPackString(data, "tempo_total_isquemia")
+	healthPackIschemia.Tempo_restante_isquemia = healthPackString(data, "tempo_restante_isquemia")
+	healthPackIschemia.Hora_isquemia = healthPackString(data, "hora_isquemia")
+	healthPackIschemia.Timeinfo_sp2 = healthPackString(data, "timeinfo_sp2")
+
+	// Tags
+	if healthPackIschemia.Orgao != "" {
+		sb.WriteString(`,orgao=`)
+		sb.WriteString(tagValueEscaper.Replace(healthPackIschemia.Orgao))
+	}
+	if healthPackIschemia.Numtransplante != "" {
+		sb.WriteString(`,numtransplante=`)
+		sb.WriteString(tagValueEscaper.Replace(healthPackIschemia.Numtransplante))
+	}
+
+	// Fields
+	writeField := func(key string, value string) {
+		if value == "" {
+			return
+		}
+		if fields.Len() == 0 {
+			fields.WriteString(` `)
+		} else {
+			fields.WriteString(`,`)
+		}
+		fields.WriteString(key)
+		fields.WriteString(`=`)
+		fields.WriteString(value)
+	}
+	writeDuration := func(key string, value string) {
+		if value == "" {
+			return
+		}
+		d, ok := parseIschemiaDuration(value)
+		if !ok {
+			fmt.Printf("\nInvalid duration %q for %s in HealthPackMeasurement - Ischemia", value, key)
+			return
+		}
+		writeField(key, strconv.FormatFloat(d.Seconds(), 'f', -1, 64))
+	}
+	writeString := func(key string, value string) {
+		if value == "" {
+			return
+		}
+		writeField(key, `"`+fieldStringEscaper.Replace(value)+`"`)
+	}
+
+	writeDuration("tempo_total_isquemia", healthPackIschemia.Tempo_total_isquemia)
+	writeDuration("tempo_restante_isquemia", healthPackIschemia.Tempo_restante_isquemia)
+	writeDuration("hora_isquemia", healthPackIschemia.Hora_isquemia)
+	writeString("idModal", healthPackIschemia.IdModal)
+	writeString("IdOperador", healthPackIschemia.IdOperador)
+	writeString("niveldepermissao", healthPackIschemia.Niveldepermissao)
+	writeString("nome", healthPackIschemia.Nome)
+	writeString("numeroempresa", healthPackIschemia.Numeroempresa)
+	writeString("timeinfo_sp2", healthPackIschemia.Timeinfo_sp2)
+
+	if fields.Len() == 0 {
+		return ""
+	}
+	sb.WriteString(fields.String())
+	return sb.String()
+}
+
+// healthPackString returns a data value as trimmed text, numbers formatted as sent.
+func healthPackString(data map[string]interface{}, key string) string {
+	switch v := data[key].(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// parseIschemiaDuration reads the ischemia times of the transport box: "01d 05:30" (days, hours
+// and minutes), a clock "05:30" or "05:30:15", and "00/00/00 05:30:15" where the first number is
+// a day count. Other values in the slash part are rejected since their meaning is unknown.
+func parseIschemiaDuration(s string) (time.Duration, bool) {
+	var days int64
+
+	s = strings.TrimSpace(s)
+	if prefix, clock, ok := strings.Cut(s, " "); ok {
+		s = strings.TrimSpace(clock)
+		switch {
+		case strings.HasSuffix(prefix, "d"):
+			n, err := strconv.ParseInt(strings.TrimSuffix(prefix, "d"), 10, 64)
+			if err != nil || n < 0 {
+				return 0, false
+			}
+			days = n
+		case strings.Contains(prefix, "/"):
+			parts := strings.Split(prefix, "/")
+			for i, part := range parts {
+				n, err := strconv.ParseInt(part, 10, 64)
+				if err != nil || n < 0 || (i > 0 && n != 0) {
+					return 0, false
+				}
+				if i == 0 {
+					days = n
+				}
+			}
+		default:
+			return 0, false
+		}
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+	var clock [3]int64
+	for i, part := range parts {
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || n < 0 || (i > 0 && n > 59) {
+			return 0, false
+		}
+		clock[i] = n
+	}
+
+	return time.Duration(days)*24*time.Hour +
+		time.Duration(clock[0])*time.Hour +
+		time.Duration(clock[1])*time.Minute +
+		time.Duration(clock[2])*time.Second, true
+}
+
+// checkIschemia raises an alert when the remaining ischemia time of a parsed Ischemia record drops
+// below the threshold of its organ, and another one when it runs out. A box reporting no ischemia
+// time at all is idle and re-arms both.
+func checkIschemia(message string, deviceType string, etc string, now time.Time) {
+	line, ok := parseLine(message)
+	if !ok {
+		return
+	}
+	remainingSeconds, ok := fieldFloat(line.Fields["tempo_restante_isquemia"])
+	if !ok {
+		return
+	}
+	totalSeconds, _ := fieldFloat(line.Fields["tempo_total_isquemia"])
+	remaining := time.Duration(remainingSeconds * float64(time.Second))
+
+	deviceId := line.Tags["deviceId"]
+	organ := strings.ToLower(line.Tags["orgao"])
+
+	state, ok := ischemiaStates[deviceId]
+	if !ok {
+		state = &IschemiaState{}
+		ischemiaStates[deviceId] = state
+	}
+
+	state.Running = remainingSeconds != 0 || totalSeconds != 0
+	if !state.Running {
+		state.Low = false
+		state.Expired = false
+		return
+	}
+
+	threshold := ischemiaThreshold(organ)
+	if remaining >= threshold {
+		state.Low = false
+		state.Expired = false
+		return
+	}
+
+	var trigger string
+	switch {
+	case remaining == 0 && !state.Expired:
+		state.Low = true
+		state.Expired = true
+		trigger = "tempo_restante_isquemia expired"
+	case remaining > 0 && !state.Low:
+		state.Low = true
+		trigger = "tempo_restante_isquemia < " + threshold.String()
+	default:
+		return
+	}
+
+	var alert Alert
+	alert.DeviceId = deviceId
+	alert.DeviceType = deviceType
+	alert.Etc = etc
+	alert.Data = organ + " ischemia remaining " + remaining.String()
+	alert.Timestamp = line.Timestamp
+	if alert.Timestamp == 0 {
+		alert.Timestamp = now.UnixNano()
+	}
+	alert.Trigger = trigger
+	alert.TriggerAt = now.Format(time.RFC3339)
+	alert.TriggerType = "ischemia"
+	alert.ActionSensor = "tempo_restante_isquemia"
+	alert.CurrentValue = strconv.FormatFloat(remainingSeconds, 'f', -1, 64)
+
+	record := formatAlert(line.Measurement, deviceType, deviceId, etc, alert)
+	emitRecord(record)
+	if kafkaAlarmTopic != "" {
+		emitRecordTo(kafkaAlarmTopic, record)
+	}
+}
+
+func ischemiaThreshold(organ string) time.Duration {
+	if threshold, ok := schema.IschemiaThresholds[organ]; ok {
+		return threshold.Duration
+	}
+	if threshold, ok := defaultIschemiaThresholds[organ]; ok {
+		return threshold
+	}
+	if threshold, ok := schema.IschemiaThresholds["*"]; ok {
+		return threshold.Duration
+	}
+	return defaultIschemiaThresholds["*"]
+}
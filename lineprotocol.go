@@ -0,0 +1,164 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Line is a line protocol record split into its parts. Tag and field values are kept as
+// written, field strings still quoted.
+type Line struct {
+	Measurement string
+	Tags        map[string]string
+	TagKeys     []string // tags in the order they were written
+	Fields      map[string]string
+	FieldKeys   []string // fields in the order they were written
+	Timestamp   int64
+}
+
+// parseLine splits a line protocol record. It returns false when line is not a valid record,
+// e.g. one of the "No data" messages.
+func parseLine(line string) (Line, bool) {
+	var l Line
+
+	parts := splitUnquoted(line, ' ')
+	if len(parts) < 2 || len(parts) > 3 {
+		return l, false
+	}
+
+	series := splitUnquoted(parts[0], ',')
+	l.Measurement = series[0]
+	l.Tags = make(map[string]string)
+	for _, tag := range series[1:] {
+		key, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			return l, false
+		}
+		l.Tags[key] = value
+		l.TagKeys = append(l.TagKeys, key)
+	}
+
+	l.Fields = make(map[string]string)
+	for _, field := range splitUnquoted(parts[1], ',') {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key == "" || value == "" {
+			return l, false
+		}
+		l.Fields[key] = value
+		l.FieldKeys = append(l.FieldKeys, key)
+	}
+
+	if len(parts) == 3 {
+		timestamp, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return l, false
+		}
+		l.Timestamp = timestamp
+	}
+
+	return l, true
+}
+
+// formatLine writes a Line back as a line protocol record, tags and fields in their key order.
+// Keys missing in Tags or Fields are left out.
+func formatLine(l Line) string {
+	var sb strings.Builder
+
+	sb.WriteString(l.Measurement)
+	for _, key := range l.TagKeys {
+		if value, ok := l.Tags[key]; ok {
+			sb.WriteString(`,`)
+			sb.WriteString(key)
+			sb.WriteString(`=`)
+			sb.WriteString(value)
+		}
+	}
+
+	sb.WriteString(` `)
+	first := true
+	for _, key := range l.FieldKeys {
+		value, ok := l.Fields[key]
+		if !ok {
+			continue
+		}
+		if !first {
+			sb.WriteString(`,`)
+		}
+		first = false
+		sb.WriteString(key)
+		sb.WriteString(`=`)
+		sb.WriteString(value)
+	}
+
+	if l.Timestamp != 0 {
+		sb.WriteString(` `)
+		sb.WriteString(strconv.FormatInt(l.Timestamp, 10))
+	}
+	return sb.String()
+}
+
+// appendFields adds fields, formatted as ",key=value...", after the last field of line.
+func appendFields(line string, fields string) string {
+	if fields == "" {
+		return line
+	}
+	parts := splitUnquoted(line, ' ')
+	if len(parts) < 2 {
+		return line
+	}
+	parts[1] = parts[1] + fields
+	return strings.Join(parts, " ")
+}
+
+// splitUnquoted splits s at every sep that is neither escaped nor inside a quoted string.
+func splitUnquoted(s string, sep byte) []string {
+	var parts []string
+
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// lineMeasurement returns the measurement of a record, up to the first unescaped comma or space,
+// without parsing the rest of it.
+func lineMeasurement(line string) string {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case ',', ' ':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// fieldFloat returns the numeric value of a field, booleans being 0 or 1.
+func fieldFloat(value string) (float64, bool) {
+	switch value {
+	case "true", "t", "T", "True", "TRUE":
+		return 1, true
+	case "false", "f", "F", "False", "FALSE":
+		return 0, true
+	}
+
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "i"), "u")
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	return f, true
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"strings"
+)
+
+// FCntState is the frame counter history of a LoRaWAN device.
+type FCntState struct {
+	FCnt        uint64
+	PayloadHash [32]byte
+	Window      []uint64 // frames missed before each of the last uplinks
+
+	StepBacks    int    // consecutive uplinks below FCnt, each above the previous one
+	StepBackFCnt uint64 // frame counter of the last of them
+}
+
+type LinkQuality struct {
+	FCnt            uint64
+	Gap             uint64 // uplinks missed right before this one
+	Received        uint64 // uplinks received in the window
+	Missed          uint64 // uplinks missed in the window
+	PacketErrorRate float64
+	Reset           bool // frame counter went back to near 0, the device rejoined or rebooted
+	Replay          bool // frame counter repeated with a different payload
+	OutOfOrder      bool // frame counter went back otherwise, a late or replayed uplink
+}
+
+// fCntStates is keyed by deviceId and only touched from the main loop goroutine.
+var fCntStates = make(map[string]*FCntState)
+
+// fCntWindow is the number of received uplinks the packet error rate is computed over.
+var fCntWindow = 100
+
+// fCntResetMax is the highest frame counter a device restarts from after a rejoin or reboot.
+// A counter going back to at most fCntResetMax from more than twice it is a reset.
+var fCntResetMax = uint64(16)
+
+// fCntResetStepBacks consecutive rising uplinks below the frame counter are also a reset, for a
+// device whose first uplinks after the reset were lost or that reset from a low counter.
+var fCntResetStepBacks = 3
+
+// trackFCnt updates the frame counter state of deviceId. It returns false for an exact copy of
+// the previous uplink, which says nothing about the link.
+func trackFCnt(deviceId string, fCnt uint64, data string) (LinkQuality, bool) {
+	var linkQuality LinkQuality
+	linkQuality.FCnt = fCnt
+	hash := sha256.Sum256([]byte(data))
+
+	state, ok := fCntStates[deviceId]
+	if !ok {
+		state = &FCntState{FCnt: fCnt, PayloadHash: hash}
+		fCntStates[deviceId] = state
+		state.Window = append(state.Window, 0)
+		linkQuality.Received = 1
+		return linkQuality, true
+	}
+
+	switch {
+	case fCnt == state.FCnt && hash == state.PayloadHash:
+		return linkQuality, false
+
+	case fCnt == state.FCnt:
+		linkQuality.Replay = true
+
+	case fCnt > state.FCnt:
+		linkQuality.Gap = fCnt - state.FCnt - 1
+		state.StepBacks = 0
+
+	// 16 bit counters wrap from 0xFFFF to 0
+	case state.FCnt <= 0xFFFF && state.FCnt >= 0xFF00 && fCnt < 0x100:
+		linkQuality.Gap = 0xFFFF - state.FCnt + fCnt
+		state.StepBacks = 0
+
+	case fCnt <= fCntResetMax && state.FCnt > 2*fCntResetMax:
+		linkQuality.Reset = true
+		state.Window = state.Window[:0]
+		state.StepBacks = 0
+
+	// Any other step back is an uplink delayed past newer ones or replayed and the state stays,
+	// unless it continues a run of rising step backs long enough to be a new counter
+	default:
+		if state.StepBacks > 0 && fCnt > state.StepBackFCnt {
+			state.StepBacks++
+		} else {
+			state.StepBacks = 1
+		}
+		state.StepBackFCnt = fCnt
+
+		if state.StepBacks >= fCntResetStepBacks {
+			linkQuality.Reset = true
+			state.Window = state.Window[:0]
+			state.StepBacks = 0
+			break
+		}
+		linkQuality.OutOfOrder = true
+		lnsOutOfOrder.Add(1)
+	}
+
+	if !linkQuality.Replay && !linkQuality.OutOfOrder {
+		state.Window = append(state.Window, linkQuality.Gap)
+		if len(state.Window) > fCntWindow {
+			state.Window = state.Window[len(state.Window)-fCntWindow:]
+		}
+		state.FCnt = fCnt
+		state.PayloadHash = hash
+	}
+
+	linkQuality.Received = uint64(len(state.Window))
+	for _, missed := range state.Window {
+		linkQuality.Missed += missed
+	}
+	if linkQuality.Received+linkQuality.Missed > 0 {
+		linkQuality.PacketErrorRate = roundFloat(float64(linkQuality.Missed)/float64(linkQuality.Received+linkQuality.Missed), 4)
+	}
+
+	return linkQuality, true
+}
+
+// lnsLinkQualityRecord formats the lns_link_quality line of an uplink.
+func lnsLinkQualityRecord(deviceId string, etc string, linkQuality LinkQuality, timestamp int64) string {
+	var sb strings.Builder
+
+	// Measurement
+	sb.WriteString("lns_link_quality")
+
+	// Tags
+	sb.WriteString(`,deviceType=LNS`)
+	sb.WriteString(`,deviceId=`)
+	sb.WriteString(deviceId)
+	sb.WriteString(`,origin=`)
+	sb.WriteString(etc)
+
+	// Fields
+	sb.WriteString(` `)
+	sb.WriteString(`fCnt=`)
+	sb.WriteString(strconv.FormatUint(linkQuality.FCnt, 10))
+	sb.WriteString(`,gap=`)
+	sb.WriteString(strconv.FormatUint(linkQuality.Gap, 10))
+	sb.WriteString(`,received=`)
+	sb.WriteString(strconv.FormatUint(linkQuality.Received, 10))
+	sb.WriteString(`,missed=`)
+	sb.WriteString(strconv.FormatUint(linkQuality.Missed, 10))
+	sb.WriteString(`,packetErrorRate=`)
+	sb.WriteString(strconv.FormatFloat(linkQuality.PacketErrorRate, 'f', -1, 64))
+	sb.WriteString(`,reset=`)
+	sb.WriteString(strconv.FormatBool(linkQuality.Reset))
+	sb.WriteString(`,replay=`)
+	sb.WriteString(strconv.FormatBool(linkQuality.Replay))
+	sb.WriteString(`,outOfOrder=`)
+	sb.WriteString(strconv.FormatBool(linkQuality.OutOfOrder))
+
+	// Timestamp_ns
+	sb.WriteString(` `)
+	sb.WriteString(strconv.FormatInt(timestamp, 10))
+
+	return sb.String()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestTrackFCnt(t *testing.T) {
+	t.Cleanup(func() { fCntStates = make(map[string]*FCntState) })
+
+	tests := []struct {
+		name       string
+		fCnt       uint64
+		data       string // payload, the fCnt when empty
+		reset      bool
+		replay     bool
+		outOfOrder bool
+		gap        uint64
+		received   uint64
+	}{
+		{name: "first", fCnt: 100, received: 1},
+		{name: "next", fCnt: 101, received: 2},
+		{name: "after a gap", fCnt: 104, gap: 2, received: 3},
+		{name: "late uplink", fCnt: 103, outOfOrder: true, received: 3},
+		{name: "replayed old uplink", fCnt: 50, outOfOrder: true, received: 3},
+		{name: "older uplink", fCnt: 20, outOfOrder: true, received: 3},
+		{name: "same fCnt other payload", fCnt: 104, data: "other", replay: true, received: 3},
+		{name: "continues after the late ones", fCnt: 105, received: 4},
+		{name: "rejoin", fCnt: 0, reset: true, received: 1},
+		{name: "after the rejoin", fCnt: 1, received: 2},
+		{name: "before a reset with lost uplinks", fCnt: 500, gap: 498, received: 3},
+		{name: "first uplink kept after the reset", fCnt: 40, outOfOrder: true, received: 3},
+		{name: "second uplink kept after the reset", fCnt: 41, outOfOrder: true, received: 3},
+		{name: "third uplink kept after the reset", fCnt: 42, reset: true, received: 1},
+		{name: "after the reset with lost uplinks", fCnt: 43, received: 2},
+		{name: "rejoin again", fCnt: 0, reset: true, received: 1},
+		{name: "before a reset from a low counter", fCnt: 5, gap: 4, received: 2},
+		{name: "first uplink after the low reset", fCnt: 1, outOfOrder: true, received: 2},
+		{name: "second uplink after the low reset", fCnt: 2, outOfOrder: true, received: 2},
+		{name: "third uplink after the low reset", fCnt: 3, reset: true, received: 1},
+		{name: "after the low reset", fCnt: 4, received: 2},
+	}
+	for _, tt := range tests {
+		data := tt.data
+		if data == "" {
+			data = strconv.FormatUint(tt.fCnt, 10)
+		}
+		got, ok := trackFCnt("0004a30b00000001", tt.fCnt, data)
+		if !ok {
+			t.Fatalf("%s: taken as a copy", tt.name)
+		}
+		if got.Reset != tt.reset || got.Replay != tt.replay || got.OutOfOrder != tt.outOfOrder || got.Gap != tt.gap || got.Received != tt.received {
+			t.Errorf("%s: got %+v", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Liveness is the reporting state of a device.
+type Liveness struct {
+	DeviceType  string
+	Measurement string
+	DeviceId    string
+	LastSeen    time.Time
+	Interval    time.Duration // expected reporting interval
+	Configured  bool          // Interval comes from the schema instead of being learned
+	Samples     int           // intervals learned so far
+	Offline     bool
+	NeverSeen   bool // seeded from the registry at startup, no message yet
+}
+
+// livenessStates is keyed by deviceType/deviceId and only touched from the main loop goroutine.
+var livenessStates = make(map[string]*Liveness)
+
+var (
+	// A device is offline after livenessFactor expected intervals without messages
+	livenessFactor = 3.0
+	// Learned intervals are only trusted after livenessMinSamples uplinks
+	livenessMinSamples = 3
+)
+
+// seedLiveness tracks the registry devices with a reporting_interval from startup, so that a
+// device that never reports after a restart is also reported offline. Their topic device type is
+// not known before the first message, so they are kept under seedLivenessKey until then.
+func seedLiveness(now time.Time) {
+	for _, organization := range schema.Organizations {
+		for _, application := range organization.Applications {
+			for _, device := range application.Devices {
+				if device.ReportingInterval.Duration <= 0 {
+					continue
+				}
+				livenessStates[seedLivenessKey(device.DeviceType, device.DeviceId)] = &Liveness{
+					DeviceType:  device.DeviceType,
+					Measurement: device.DeviceType,
+					DeviceId:    device.DeviceId,
+					LastSeen:    now,
+					Interval:    device.ReportingInterval.Duration,
+					Configured:  true,
+					NeverSeen:   true,
+				}
+			}
+		}
+	}
+}
+
+func seedLivenessKey(registryType string, deviceId string) string {
+	return "registry/" + registryType + "/" + deviceId
+}
+
+// markSeen records a message from a device and emits an online alert when it was offline.
+func markSeen(deviceType string, measurement string, deviceId string, now time.Time) {
+	key := deviceType + "/" + deviceId
+	device := lookupDevice(deviceId, measurement, deviceType)
+
+	liveness, ok := livenessStates[key]
+	if !ok && device != nil {
+		// The first message of a device seeded from the registry
+		seedKey := seedLivenessKey(device.DeviceType, device.DeviceId)
+		if liveness, ok = livenessStates[seedKey]; ok {
+			delete(livenessStates, seedKey)
+			liveness.DeviceType = deviceType
+			livenessStates[key] = liveness
+		}
+	}
+	if !ok {
+		liveness = &Liveness{DeviceType: deviceType, Measurement: measurement, DeviceId: deviceId}
+		livenessStates[key] = liveness
+	}
+
+	if device != nil && device.ReportingInterval.Duration > 0 {
+		liveness.Interval = device.ReportingInterval.Duration
+		liveness.Configured = true
+	} else if !liveness.LastSeen.IsZero() && !liveness.Offline {
+		// Exponential moving average of the time between messages, outages are left out
+		interval := now.Sub(liveness.LastSeen)
+		if liveness.Samples == 0 {
+			liveness.Interval = interval
+		} else {
+			liveness.Interval = time.Duration(0.8*float64(liveness.Interval) + 0.2*float64(interval))
+		}
+		liveness.Samples++
+	}
+
+	if liveness.Offline {
+		liveness.Offline = false
+		emitRecord(livenessAlert(liveness, "online", now))
+		fmt.Printf("\nDevice %s is back online after %s", key, now.Sub(liveness.LastSeen).Round(time.Second))
+	}
+
+	liveness.Measurement = measurement
+	liveness.LastSeen = now
+	liveness.NeverSeen = false
+}
+
+// checkLiveness emits an offline alert for every device silent for longer than expected.
+func checkLiveness(now time.Time) {
+	for key, liveness := range livenessStates {
+		if liveness.Offline || liveness.Interval <= 0 {
+			continue
+		}
+		if !liveness.Configured && liveness.Samples < livenessMinSamples {
+			continue
+		}
+
+		if now.Sub(liveness.LastSeen) > time.Duration(livenessFactor*float64(liveness.Interval)) {
+			liveness.Offline = true
+			emitRecord(livenessAlert(liveness, "offline", now))
+			fmt.Printf("\nDevice %s is offline, last seen %s", key, liveness.LastSeen.Format(time.RFC3339))
+		}
+	}
+}
+
+func livenessAlert(liveness *Liveness, trigger string, now time.Time) string {
+	var alert Alert
+
+	silence := now.Sub(liveness.LastSeen)
+
+	alert.DeviceId = liveness.DeviceId
+	alert.DeviceType = liveness.DeviceType
+	alert.Etc = "gateway"
+	alert.Data = "expected every " + liveness.Interval.Round(time.Second).String() + ", silent for " + silence.Round(time.Second).String()
+	if liveness.NeverSeen {
+		alert.Data += " since the gateway started"
+	}
+	alert.Timestamp = now.UnixNano()
+	alert.Trigger = trigger
+	alert.TriggerAt = liveness.LastSeen.Format(time.RFC3339)
+	alert.TriggerType = "liveness"
+	alert.ActionSensor = "lastSeen"
+	alert.CurrentValue = strconv.FormatFloat(silence.Seconds(), 'f', 0, 64)
+
+	return formatAlert(liveness.Measurement, alert.DeviceType, alert.DeviceId, alert.Etc, alert)
+}
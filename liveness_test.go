@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLivenessSeededFromRegistry(t *testing.T) {
+	saved := schema
+	t.Cleanup(func() {
+		schema = saved
+		livenessStates = make(map[string]*Liveness)
+		pendingRecords = pendingRecords[:0]
+	})
+	schema = Schema{Organizations: []SchemaOrganization{{
+		OrganizationName: "SmartCampusMaua",
+		Applications: []SchemaApplication{{Devices: []SchemaDevice{
+			{DeviceId: "0001", DeviceType: "WaterTankLevel", ReportingInterval: Duration{15 * time.Minute}},
+			{DeviceId: "0002", DeviceType: "WaterTankLevel", ReportingInterval: Duration{15 * time.Minute}},
+			{DeviceId: "0001", DeviceType: "HealthPack"},
+		}}},
+	}}}
+	start := time.Date(2025, 10, 19, 10, 0, 0, 0, time.UTC)
+
+	livenessStates = make(map[string]*Liveness)
+	pendingRecords = pendingRecords[:0]
+	seedLiveness(start)
+
+	// 0001 reports through the LNS topics, 0002 never does
+	markSeen("LNS", "WaterTankLevel", "0001", start.Add(10*time.Minute))
+	checkLiveness(start.Add(50 * time.Minute))
+
+	if len(livenessStates) != 2 || livenessStates["LNS/0001"] == nil {
+		t.Fatalf("seeded state not taken over by the first message: %v", livenessStates)
+	}
+	if len(pendingRecords) != 1 {
+		t.Fatalf("want one offline alert, got %d", len(pendingRecords))
+	}
+	alert := pendingRecords[0].Value
+	if !strings.Contains(alert, "0002") || !strings.Contains(alert, "since the gateway started") {
+		t.Errorf("unexpected alert %s", alert)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"math"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -69,72 +70,6 @@ type HealthPackUpProps struct {
 	DeviceIp   string `json:"deviceIp"`
 }
 
-type HealthPackInertias struct {
-	FAccX        string `json:"fAccX"`        // :"0.0"
-	FAccY        string `json:"fAccY"`        // :"0.0"
-	FAccZ        string `json:"fAccZ"`        // :"0.0"
-	AccX         string `json:"accX"`         // :"944.000000"
-	AccY         string `json:"accY"`         // :"-356.000000"
-	AccZ         string `json:"accZ"`         // :"-16960.000000"
-	GyrX         string `json:"gyrX"`         // :"-491.000000"
-	GyrY         string `json:"gyrY"`         // :"15.000000"
-	GyrZ         string `json:"gyrZ"`         // :"196.000000"
-	ContimpactoX string `json:"contimpactoX"` // :"944.000000"
-	ContimpactoY string `json:"contimpactoY"` // :"412.000000"
-	ContimpactoZ string `json:"contimpactoZ"` // :"17968.000000"
-	Pitch        string `json:"pitch"`        // :"-1.200725"
-	Roll         string `json:"roll"`         // :"-3.185352"
-	Yaw          string `json:"yaw"`          // :"0.000000"}
-}
-
-type HealthPackTracking struct {
-	Latitude               string `json:"latitude"`               // :"0.000000"
-	Longitude              string `json:"longitude"`              // :"0.000000"
-	Tempbateriasecundaria  string `json:"tempbateriasecundaria"`  // :"24.2"
-	Tempbateriaprincipal   string `json:"tempbateriaprincipal"`   // :"23.6"
-	Temperaturacondensador string `json:"temperaturacondensador"` // :"28.1"
-	Temperaturacuba1       string `json:"temperaturacuba1"`       // :"-0.9"
-	Temperaturacuba2       string `json:"temperaturacuba2"`       // :"11.4"
-	TemperaturaexternaLL   string `json:"temperaturaexternaLL"`   // :"36.3"
-	TemperaturaexternaLS   string `json:"temperaturaexternaLS"`   // :"8.4"
-	Temperaturaexterna     string `json:"temperaturaexterna"`     // :"28.1"
-	Temperaturadissipador  string `json:"temperaturadissipador"`  // :"26.5"
-	Correntebateria        string `json:"correntebateria"`        // :"0.0"
-	Correntecompressor     string `json:"correntecompressor"`     // :"3.9"
-	Correntepeltier        string `json:"correntepeltier"`        // :"0.0"
-	Correntecooler         string `json:"correntecooler"`         // :"0.0"
-	Correnteexaustor       string `json:"correnteexaustor"`       // :"0.0"
-	Temperaturacompressor  string `json:"temperaturacompressor"`  // :"44.8"
-	Setpoint_pid1          string `json:"setpoint_pid1"`          // :"-5.0"
-	Valor_pid1_atual       string `json:"valor_pid1_atual"`       // :"-0.9"
-	Esforco_pid1           string `json:"esforco_pid1"`           // :"536.0"
-	Setpoint_pid2          string `json:"setpoint_pid2"`          // :"50.0"
-	Valor_pid2_atual       string `json:"valor_pid2_atual"`       // :"44.8"
-	Esforco_pid2           string `json:"esforco_pid2"`           // :"0.0"}
-}
-
-type HealthPackStatus struct {
-	Vbateriaprincipal           string `json:"vbateriaprincipal"`           // :"21.8"
-	Vbateriasecundaria          string `json:"vbateriasecundaria"`          // :"4.2"
-	Ventradafonteexterna        string `json:"ventradafonteexterna"`        // :"21.8"
-	Numerocaixa                 string `json:"numerocaixa"`                 // :"0.0"
-	Estadomaquina               string `json:"estadomaquina"`               // :"53.0"
-	Timestamp                   string `json:"timestamp"`                   // :"0.0"
-	IdFalha                     string `json:"idFalha"`                     // :"0.0"
-	Porcentagemsinalcomunicacao string `json:"porcentagemsinalcomunicacao"` // :"0.0"
-	FatorRH                     string `json:"fatorRH"`                     // :"0.0"
-	Btdown                      string `json:"btdown"`                      // :"0.0"
-	Btselect                    string `json:"btselect"`                    // :"0.0"
-	Btup                        string `json:"btup"`                        // :"0.0"
-	Tecla_enter                 string `json:"tecla_enter"`                 // :"0.0"
-	Statustampaprincipal        string `json:"statustampaprincipal"`        // :"1.0"
-	Statusserialprincipal       string `json:"statusserialprincipal"`       // :"0.0"
-	Statusserialsecundaria      string `json:"statusserialsecundaria"`      // :"0.0"
-	Statustampacasamaq          string `json:"statustampacasamaq"`          // :"0.0"
-	Controle_peltier            string `json:"controle_peltier"`            // :"0.0"
-	Porcentagem_bat             string `json:"porcentagem_bat"`             // :"100.0"}
-}
-
 type HealthPackIschemia struct {
 	IdModal                 string `json:"idModal"`
 	IdOperador              string `json:"IdOperador"`              // :""
@@ -154,15 +89,11 @@ type HealthPackAlarm struct {
 }
 
 type NspiUp struct {
-	Measurement string `json:"measurement"`
-	DeviceId    string `json:"deviceId"`
-	DeviceType  string `json:"deviceType"`
-	Data        string `json:"data"`
-	Timestamp   int64  `json:"timestamp"`
-}
-
-type NspiGenericJson struct {
-	Data string `json:"data"`
+	Measurement string          `json:"measurement"`
+	DeviceId    string          `json:"deviceId"`
+	DeviceType  string          `json:"deviceType"`
+	Data        json.RawMessage `json:"data"` // a JSON object, or a string holding one
+	Timestamp   int64           `json:"timestamp"`
 }
 type EvseUp struct {
 	FeatureName   string `json:"featureName"`
@@ -179,7 +110,9 @@ type EvseUp struct {
 }
 
 type EvseMeterValue struct {
-	ForwardEnergy float64 `json:"forwardEnergy"`
+	ForwardEnergy *float64               `json:"forwardEnergy"` // Wh
+	TransactionId OcppId                 `json:"transactionId"`
+	MeterValue    []EvseMeterValueSample `json:"meterValue"`
 }
 
 type EvseStatusNotification struct {
@@ -191,16 +124,17 @@ type EvseStatusNotification struct {
 }
 
 type EvseStartTransaction struct {
-	StartMeter    int64  `json:"startMeter"`
-	TransactionId string `json:"transactionId"`
+	StartMeter    *int64 `json:"startMeter"`
+	TransactionId OcppId `json:"transactionId"`
 	StartTime     int64  `json:"startTime"`
 	IdTag         string `json:"idTag"`
 }
 
 type EvseStopTransaction struct {
-	TransactionId string `json:"transactionId"`
-	MeterStop     int64  `json:"meterStop"`
+	TransactionId OcppId `json:"transactionId"`
+	MeterStop     *int64 `json:"meterStop"` // Wh, nil when the charger sent none
 	StopTime      int64  `json:"stopTime"`
+	Reason        string `json:"reason"`
 }
 type LnsCommand struct {
 	Measurement string
@@ -1228,7 +1162,7 @@ func b64ToByte(b64 string) ([]byte, error) {
 	return b, err
 }
 
-func parseLnsMeasurement(measurement string, data string, port uint64) string {
+func parseLnsMeasurement(measurement string, deviceId string, data string, port uint64, timestamp int64) string {
 	// measurements format
 	var sb strings.Builder
 
@@ -1280,6 +1214,7 @@ func parseLnsMeasurement(measurement string, data string, port uint64) string {
 
 			sb.WriteString(`,distance=`)
 			sb.WriteString(strconv.FormatUint(uint64(waterTankLevel.Distance), 10))
+			sb.WriteString(waterTankLevelFields(deviceId, waterTankLevel.Distance))
 			sb.WriteString(`,boardVoltage=`)
 			sb.WriteString(strconv.FormatFloat(waterTankLevel.BoardVoltage, 'f', -1, 64))
 
@@ -1303,6 +1238,7 @@ func parseLnsMeasurement(measurement string, data string, port uint64) string {
 
 			sb.WriteString(`,counter=`)
 			sb.WriteString(strconv.FormatUint(uint64(hydrometer.Counter), 10))
+			sb.WriteString(counterFields(deviceId, measurement, "counter", float64(hydrometer.Counter), 24, 1, timestamp, "flowRate", time.Minute))
 			sb.WriteString(`,boardVoltage=`)
 			sb.WriteString(strconv.FormatFloat(hydrometer.BoardVoltage, 'f', -1, 64))
 
@@ -1316,6 +1252,9 @@ func parseLnsMeasurement(measurement string, data string, port uint64) string {
 			sb.WriteString(strconv.FormatFloat(energyMeter.ForwardEnergy, 'f', -1, 64))
 			sb.WriteString(`,reverseEnergy=`)
 			sb.WriteString(strconv.FormatFloat(energyMeter.ReverseEnergy, 'f', -1, 64))
+			// kWh per hour is the average power in kW
+			sb.WriteString(counterFields(deviceId, measurement, "forwardEnergy", energyMeter.ForwardEnergy, 32, energyMeterStep, timestamp, "forwardPower", time.Hour))
+			sb.WriteString(counterFields(deviceId, measurement, "reverseEnergy", energyMeter.ReverseEnergy, 32, energyMeterStep, timestamp, "reversePower", time.Hour))
 			sb.WriteString(`,boardVoltage=`)
 			sb.WriteString(strconv.FormatFloat(energyMeter.BoardVoltage, 'f', -1, 64))
 
@@ -1354,6 +1293,7 @@ func parseLnsMeasurement(measurement string, data string, port uint64) string {
 			sb.WriteString(strconv.FormatBool(sprinkler.Solenoid3))
 			sb.WriteString(`,counter=`)
 			sb.WriteString(strconv.FormatUint(uint64(sprinkler.Counter), 10))
+			sb.WriteString(counterFields(deviceId, measurement, "counter", float64(sprinkler.Counter), 24, 1, timestamp, "flowRate", time.Minute))
 			sb.WriteString(`,boardVoltage=`)
 			sb.WriteString(strconv.FormatFloat(sprinkler.BoardVoltage, 'f', -1, 64))
 
@@ -1550,6 +1490,7 @@ func parseLnsMeasurement(measurement string, data string, port uint64) string {
 				weatherStation.C1Count = port4.C1Count
 				sb.WriteString(`,c1Count=`)
 				sb.WriteString(strconv.FormatUint(weatherStation.C1Count, 10))
+				sb.WriteString(counterFields(deviceId, measurement, "c1Count", float64(weatherStation.C1Count), 16, 1, timestamp, "c1Rate", time.Minute))
 			}
 			if port4.IsC2State == true {
 				weatherStation.C2State = port4.C2State
@@ -1560,6 +1501,7 @@ func parseLnsMeasurement(measurement string, data string, port uint64) string {
 				weatherStation.C2Count = port4.C2Count
 				sb.WriteString(`,c2Count=`)
 				sb.WriteString(strconv.FormatUint(weatherStation.C2Count, 10))
+				sb.WriteString(counterFields(deviceId, measurement, "c2Count", float64(weatherStation.C2Count), 16, 1, timestamp, "c2Rate", time.Minute))
 			}
 			if port4.IsInternalTemperature == true {
 				weatherStation.InternalTemperature = port4.InternalTemperature
@@ -1627,6 +1569,9 @@ func parseLnsMeasurement(measurement string, data string, port uint64) string {
 	return sb.String()
 }
 
+// lnsDedup drops copies of an uplink seen within DEDUP_WINDOW, nil when deduplication is disabled
+var lnsDedup *DedupCache
+
 func parseLns(measurement string, deviceId string, direction string, etc string, message string) string {
 	var sb strings.Builder
 	var lnsUp LnsUp
@@ -1725,6 +1670,14 @@ func parseLns(measurement string, deviceId string, direction string, etc string,
 
 	// json.Unmarshal([]byte(message), &lns)
 
+	if direction == "up" && lnsDedup != nil && lnsUp.DeviceId != "" {
+		if lnsDedup.Seen(time.Now(), lnsDedupKeys(lnsUp, lnsChirpStackV4Up.DeduplicationId)...) {
+			lnsDuplicatesDropped.Add(1)
+			fmt.Printf("\nDuplicate uplink from %s fCnt %d via %s dropped", lnsUp.DeviceId, lnsUp.FCnt, etc)
+			return ""
+		}
+	}
+
 	if direction == "up" {
 		// Measurement
 		sb.WriteString(lnsUp.Measurement)
@@ -1759,12 +1712,18 @@ func parseLns(measurement string, deviceId string, direction string, etc string,
 		sb.WriteString(strconv.FormatInt(int64(lnsUp.RxInfoRssi_0), 10))
 		sb.WriteString(`,rxSnr_0=`)
 		sb.WriteString(strconv.FormatFloat(lnsUp.RxInfoSnr_0, 'f', -1, 64))
-		sb.WriteString(`,rxLat_0=`)
-		sb.WriteString(strconv.FormatFloat(lnsUp.RxInfoLat_0, 'f', -1, 64))
-		sb.WriteString(`,rxLon_0=`)
-		sb.WriteString(strconv.FormatFloat(lnsUp.RxInfoLon_0, 'f', -1, 64))
-		sb.WriteString(`,rxAlt_0=`)
-		sb.WriteString(strconv.FormatUint(uint64(lnsUp.RxInfoAlt_0), 10))
+		// Gateways without a configured position report 0, 0
+		if validCoordinate(lnsUp.RxInfoLat_0, lnsUp.RxInfoLon_0) {
+			sb.WriteString(`,rxLat_0=`)
+			sb.WriteString(strconv.FormatFloat(lnsUp.RxInfoLat_0, 'f', -1, 64))
+			sb.WriteString(`,rxLon_0=`)
+			sb.WriteString(strconv.FormatFloat(lnsUp.RxInfoLon_0, 'f', -1, 64))
+			sb.WriteString(`,rxAlt_0=`)
+			sb.WriteString(strconv.FormatUint(uint64(lnsUp.RxInfoAlt_0), 10))
+			sb.WriteString(`,rxPositionValid=true`)
+		} else {
+			sb.WriteString(`,rxPositionValid=false`)
+		}
 		sb.WriteString(`,fPort=`)
 		sb.WriteString(strconv.FormatUint(uint64(lnsUp.FPort), 10))
 		sb.WriteString(`,fCnt=`)
@@ -1773,11 +1732,15 @@ func parseLns(measurement string, deviceId string, direction string, etc string,
 		sb.WriteString(lnsUp.Data)
 		sb.WriteString(`"`)
 
-		sb.WriteString(parseLnsMeasurement(lnsUp.Measurement, lnsUp.Data, lnsUp.FPort))
+		sb.WriteString(parseLnsMeasurement(lnsUp.Measurement, deviceId, lnsUp.Data, lnsUp.FPort, lnsUp.RxInfoTime_0))
 
 		// Timestamp_ms
 		sb.WriteString(` `)
 		sb.WriteString(strconv.FormatInt(int64(lnsUp.RxInfoTime_0), 10))
+
+		if linkQuality, ok := trackFCnt(deviceId, lnsUp.FCnt, lnsUp.Data); ok {
+			emitRecord(lnsLinkQualityRecord(deviceId, etc, linkQuality, lnsUp.RxInfoTime_0))
+		}
 	}
 	// fmt.Printf("\n\nChirpstack %s\n\n", sb.String())
 
@@ -1821,70 +1784,7 @@ func parseLns(measurement string, deviceId string, direction string, etc string,
 	if direction == "alert" {
 		json.Unmarshal([]byte(message), &alert)
 
-		var trigger string
-		var triggerAt string
-		var triggerType string
-		var actionSensor string
-
-		if alert.Trigger != "" {
-			trigger = alert.Trigger
-		} else {
-			trigger = "empty"
-		}
-
-		if alert.TriggerAt != "" {
-			triggerAt = alert.TriggerAt
-		} else {
-			triggerAt = "empty"
-		}
-
-		if alert.TriggerType != "" {
-			triggerType = alert.TriggerType
-		} else {
-			triggerType = "empty"
-		}
-
-		if alert.ActionSensor != "" {
-			actionSensor = alert.ActionSensor
-		} else {
-			actionSensor = "empty"
-		}
-
-		sb.WriteString(measurement)
-
-		// Tags
-		sb.WriteString(`,deviceType=LNS`)
-		sb.WriteString(`,deviceId=`)
-		sb.WriteString(deviceId)
-		// sb.WriteString(`,type=alert`)
-		sb.WriteString(`,direction=`)
-		sb.WriteString(direction)
-		sb.WriteString(`,etc=`)
-		sb.WriteString(etc)
-
-		// unixTimestamp := alert.LastPlayed.UnixNano()
-		// Fields
-		sb.WriteString(` `)
-		sb.WriteString(`data="`)
-		sb.WriteString(alert.Data)
-		sb.WriteString(`",trigger="`)
-		sb.WriteString(trigger)
-		sb.WriteString(`",triggerAt="`)
-		sb.WriteString(triggerAt)
-		sb.WriteString(`",triggerType="`)
-		sb.WriteString(triggerType)
-		sb.WriteString(`"`)
-		// sb.WriteString(`",lastPlayed=`)
-		// sb.WriteString(alert.LastPlayed)
-		sb.WriteString(`,actionSensor="`)
-		sb.WriteString(actionSensor)
-		sb.WriteString(`",currentValue="`)
-		sb.WriteString(alert.CurrentValue)
-		sb.WriteString(`"`)
-
-		// Timestamp_ms
-		sb.WriteString(` `)
-		sb.WriteString(strconv.FormatInt(int64(alert.Timestamp), 10))
+		sb.WriteString(formatAlert(measurement, "LNS", deviceId, etc, alert))
 	}
 
 	return sb.String()
@@ -1902,20 +1802,35 @@ func parseEvseMeasurement(measurement string, data string) string {
 		var evseMeterValue EvseMeterValue
 		json.Unmarshal([]byte(data), &evseMeterValue)
 
-		forwardEnergy := evseMeterValue.ForwardEnergy * 0.001
+		// Nothing was metered
+		if evseMeterValue.ForwardEnergy == nil && len(evseMeterValue.MeterValue) == 0 {
+			return ""
+		}
 
 		sb.WriteString(` `)
-		sb.WriteString(`forwardEnergy=`)
-		sb.WriteString(strconv.FormatFloat(forwardEnergy, 'f', -1, 64))
+		if evseMeterValue.ForwardEnergy != nil {
+			sb.WriteString(`forwardEnergy=`)
+			sb.WriteString(strconv.FormatFloat(*evseMeterValue.ForwardEnergy*0.001, 'f', -1, 64))
+			if len(evseMeterValue.MeterValue) > 0 {
+				sb.WriteString(`,`)
+			}
+		}
+		// Every sampledValue is also produced as its own record by parseEvse
+		if len(evseMeterValue.MeterValue) > 0 {
+			sampledValues := 0
+			for _, sample := range evseMeterValue.MeterValue {
+				sampledValues += len(sample.SampledValue)
+			}
+			sb.WriteString(`sampledValues=`)
+			sb.WriteString(strconv.Itoa(sampledValues))
+		}
 
 	case "StatusNotification":
 		var evseStatusNotification EvseStatusNotification
 		json.Unmarshal([]byte(data), &evseStatusNotification)
 
-		sb.WriteString(`,vendorId=`)
-		sb.WriteString(evseStatusNotification.VendorId)
-		sb.WriteString(`,errorCode=`)
-		sb.WriteString(evseStatusNotification.ErrorCode)
+		writeTag(&sb, "vendorId", evseStatusNotification.VendorId)
+		writeTag(&sb, "errorCode", evseStatusNotification.ErrorCode)
 		// sb.WriteString(`,vendorErrorCode=`)
 		// sb.WriteString(evseStatusNotification.VendorErrorCode)
 		sb.WriteString(` `)
@@ -1930,10 +1845,11 @@ func parseEvseMeasurement(measurement string, data string) string {
 		json.Unmarshal([]byte(data), &evseStartTransaction)
 
 		sb.WriteString(` `)
-		sb.WriteString(`transactionId=`)
-		sb.WriteString(evseStartTransaction.TransactionId)
-		sb.WriteString(`,startMeter=`)
-		sb.WriteString(strconv.FormatInt(evseStartTransaction.StartMeter, 10))
+		writeTransactionId(&sb, evseStartTransaction.TransactionId)
+		if evseStartTransaction.StartMeter != nil {
+			sb.WriteString(`,startMeter=`)
+			sb.WriteString(strconv.FormatInt(*evseStartTransaction.StartMeter, 10))
+		}
 		sb.WriteString(`,startTime=`)
 		sb.WriteString(strconv.FormatInt(evseStartTransaction.StartTime, 10))
 		// sb.WriteString(`,idTag=`)
@@ -1944,18 +1860,23 @@ func parseEvseMeasurement(measurement string, data string) string {
 		json.Unmarshal([]byte(data), &evseStopTransaction)
 
 		sb.WriteString(` `)
-		sb.WriteString(`transactionId=`)
-		sb.WriteString(evseStopTransaction.TransactionId)
-		sb.WriteString(`,meterStop=`)
-		sb.WriteString(strconv.FormatInt(evseStopTransaction.MeterStop, 10))
+		writeTransactionId(&sb, evseStopTransaction.TransactionId)
+		if evseStopTransaction.MeterStop != nil {
+			sb.WriteString(`,meterStop=`)
+			sb.WriteString(strconv.FormatInt(*evseStopTransaction.MeterStop, 10))
+		}
 		sb.WriteString(`,stopTime=`)
 		sb.WriteString(strconv.FormatInt(evseStopTransaction.StopTime, 10))
+		writeStringField(&sb, "reason", evseStopTransaction.Reason)
+
+	default:
+		sb.WriteString(parseOcppMeasurement(measurement, data))
 	}
 
 	return sb.String()
 }
 
-func parseEvse(measurement string, deviceType string, deviceId string, direction string, etc string, message string) string {
+func parseEvse(organization string, measurement string, deviceType string, deviceId string, direction string, etc string, message string) string {
 	var sb strings.Builder
 	var evseUp EvseUp
 	var alert Alert
@@ -1965,6 +1886,12 @@ func parseEvse(measurement string, deviceType string, deviceId string, direction
 	}
 
 	if direction == "up" {
+		if ocppVersion(deviceId, etc) == "2.0.1" {
+			measurement, message = normalizeOcpp201(measurement, message, deviceType, etc)
+			if message == "" {
+				return ""
+			}
+		}
 
 		json.Unmarshal([]byte(message), &evseUp)
 
@@ -1976,8 +1903,7 @@ func parseEvse(measurement string, deviceType string, deviceId string, direction
 		sb.WriteString(evseUp.DeviceId)
 		sb.WriteString(`,deviceType=`)
 		sb.WriteString(deviceType)
-		sb.WriteString(`,connectorId=`)
-		sb.WriteString(evseUp.ConnectorId)
+		writeTag(&sb, "connectorId", evseUp.ConnectorId)
 		sb.WriteString(`,chargePointId=`)
 		sb.WriteString(evseUp.ChargePointId)
 		// sb.WriteString(`,unit=`)
@@ -1999,80 +1925,41 @@ func parseEvse(measurement string, deviceType string, deviceId string, direction
 		// Fields
 		// sb.WriteString(`,fowardEnergy=`)
 		// sb.WriteString(strconv.FormatUint(evseUp.FowardEnergy, 10))
-		sb.WriteString(parseEvseMeasurement(measurement, message))
+		fields := parseEvseMeasurement(measurement, message)
+		if fields == "" {
+			return ""
+		}
+		sb.WriteString(fields)
 
 		// Timestamp_ns
 		sb.WriteString(` `)
 		sb.WriteString(strconv.FormatInt(evseUp.Timestamp, 10))
-	}
-
-	if direction == "alert" {
-		json.Unmarshal([]byte(message), &alert)
-
-		var trigger string
-		var triggerAt string
-		var triggerType string
-		var actionSensor string
 
-		if alert.Trigger != "" {
-			trigger = alert.Trigger
-		} else {
-			trigger = "empty"
-		}
-
-		if alert.TriggerAt != "" {
-			triggerAt = alert.TriggerAt
-		} else {
-			triggerAt = "empty"
-		}
-
-		if alert.TriggerType != "" {
-			triggerType = alert.TriggerType
-		} else {
-			triggerType = "empty"
-		}
-
-		if alert.ActionSensor != "" {
-			actionSensor = alert.ActionSensor
-		} else {
-			actionSensor = "empty"
+		switch measurement {
+		case "MeterValues":
+			var evseMeterValue EvseMeterValue
+			json.Unmarshal([]byte(message), &evseMeterValue)
+			emitSampledValues(evseUp, evseMeterValue.MeterValue, evseMeterValue.TransactionId.String(), deviceType, etc)
+			addChargingSessionSamples(evseUp, evseMeterValue.MeterValue, evseMeterValue.TransactionId.String())
+		case "StartTransaction":
+			var evseStartTransaction EvseStartTransaction
+			json.Unmarshal([]byte(message), &evseStartTransaction)
+			startChargingSession(evseUp, evseStartTransaction, deviceType, etc)
+		case "StopTransaction":
+			var evseStopTransaction EvseStopTransaction
+			json.Unmarshal([]byte(message), &evseStopTransaction)
+			stopChargingSession(evseUp, evseStopTransaction, deviceType, etc)
 		}
+	}
 
-		sb.WriteString(measurement)
-
-		// Tags
-		sb.WriteString(`,deviceType=EVSE`)
-		sb.WriteString(`,deviceId=`)
-		sb.WriteString(deviceId)
-		// sb.WriteString(`,type=alert`)
-		sb.WriteString(`,direction=`)
-		sb.WriteString(direction)
-		sb.WriteString(`,etc=`)
-		sb.WriteString(etc)
+	if direction == "down" {
+		sb.WriteString(parseEvseCommand(organization, measurement, deviceType, deviceId, etc, message))
+	}
 
-		// unixTimestamp := alert.LastPlayed.UnixNano()
-		// Fields
-		sb.WriteString(` `)
-		sb.WriteString(`data="`)
-		sb.WriteString(alert.Data)
-		sb.WriteString(`",trigger="`)
-		sb.WriteString(trigger)
-		sb.WriteString(`",triggerAt="`)
-		sb.WriteString(triggerAt)
-		sb.WriteString(`",triggerType="`)
-		sb.WriteString(triggerType)
-		sb.WriteString(`"`)
-		// sb.WriteString(`",lastPlayed=`)
-		// sb.WriteString(alert.LastPlayed)
-		sb.WriteString(`,actionSensor="`)
-		sb.WriteString(actionSensor)
-		sb.WriteString(`",currentValue="`)
-		sb.WriteString(alert.CurrentValue)
-		sb.WriteString(`"`)
+	if direction == "alert" {
+		json.Unmarshal([]byte(message), &alert)
 
-		// Timestamp_ms
-		sb.WriteString(` `)
-		sb.WriteString(strconv.FormatInt(int64(alert.Timestamp), 10))
+		sb.WriteString(formatAlert(measurement, "EVSE", deviceId, etc, alert))
 	}
 	return sb.String()
 }
@@ -2080,7 +1967,6 @@ func parseEvse(measurement string, deviceType string, deviceId string, direction
 func parseHealthPackMeasurement(measurement string, data string) string {
 	var sb strings.Builder
 	var healthPackUp HealthPackUp
-	var ok bool
 
 	if data == "" {
 		return "No data"
@@ -2089,678 +1975,36 @@ func parseHealthPackMeasurement(measurement string, data string) string {
 	json.Unmarshal([]byte(data), &healthPackUp)
 
 	switch measurement {
-	case "Inertias":
-		var healthPackInertias HealthPackInertias
-
-		if healthPackInertias.FAccX, ok = healthPackUp.Data["fAccX"].(string); ok {
-			if healthPackInertias.FAccX == "" {
-				healthPackInertias.FAccX = "empty"
-			}
-		} else {
-			return "No valid key fAccX to parse in HealthPackMeasurement - Inertias."
-		}
-		if healthPackInertias.FAccY, ok = healthPackUp.Data["fAccY"].(string); ok {
-			if healthPackInertias.FAccY == "" {
-				healthPackInertias.FAccY = "empty"
-			}
-		} else {
-			return "No valid key fAccY to parse in HealthPackMeasurement - Inertias."
-		}
-		if healthPackInertias.FAccZ, ok = healthPackUp.Data["fAccZ"].(string); ok {
-			if healthPackInertias.FAccZ == "" {
-				healthPackInertias.FAccZ = "empty"
-			}
-		} else {
-			return "No valid key fAccZ to parse in HealthPackMeasurement - Inertias."
-		}
-		if healthPackInertias.AccX, ok = healthPackUp.Data["accX"].(string); ok {
-			if healthPackInertias.AccX == "" {
-				healthPackInertias.AccX = "empty"
-			}
-		} else {
-			return "No valid key accX to parse in HealthPackMeasurement - Inertias."
-		}
-		if healthPackInertias.AccY, ok = healthPackUp.Data["accY"].(string); ok {
-			if healthPackInertias.AccY == "" {
-				healthPackInertias.AccY = "empty"
-			}
-		} else {
-			return "No valid key accY to parse in HealthPackMeasurement - Inertias."
-		}
-		if healthPackInertias.AccZ, ok = healthPackUp.Data["accZ"].(string); ok {
-			if healthPackInertias.AccZ == "" {
-				healthPackInertias.AccZ = "empty"
-			}
-		} else {
-			return "No valid key accZ to parse in HealthPackMeasurement - Inertias."
-		}
-		if healthPackInertias.GyrX, ok = healthPackUp.Data["gyrX"].(string); ok {
-			if healthPackInertias.GyrX == "" {
-				healthPackInertias.GyrX = "empty"
-			}
-		} else {
-			return "No valid key gyrX to parse in HealthPackMeasurement - Inertias."
-		}
-		if healthPackInertias.GyrY, ok = healthPackUp.Data["gyrY"].(string); ok {
-			if healthPackInertias.GyrY == "" {
-				healthPackInertias.GyrY = "empty"
-			}
-		} else {
-			return "No valid key gyrY to parse in HealthPackMeasurement - Inertias."
-		}
-		if healthPackInertias.GyrZ, ok = healthPackUp.Data["gyrZ"].(string); ok {
-			if healthPackInertias.GyrZ == "" {
-				healthPackInertias.GyrZ = "empty"
-			}
-		} else {
-			return "No valid key gyrZ to parse in HealthPackMeasurement - Inertias."
-		}
-		if healthPackInertias.ContimpactoX, ok = healthPackUp.Data["contimpactoX"].(string); ok {
-			if healthPackInertias.ContimpactoX == "" {
-				healthPackInertias.ContimpactoX = "empty"
-			}
-		} else {
-			return "No valid key contimpactoX to parse in HealthPackMeasurement - Inertias."
-		}
-		if healthPackInertias.ContimpactoY, ok = healthPackUp.Data["contimpactoY"].(string); ok {
-			if healthPackInertias.ContimpactoY == "" {
-				healthPackInertias.ContimpactoY = "empty"
-			}
-		} else {
-			return "No valid key contimpactoY to parse in HealthPackMeasurement - Inertias."
-		}
-		if healthPackInertias.ContimpactoZ, ok = healthPackUp.Data["contimpactoZ"].(string); ok {
-			if healthPackInertias.ContimpactoZ == "" {
-				healthPackInertias.ContimpactoZ = "empty"
-			}
-		} else {
-			return "No valid key contimpactoZ to parse in HealthPackMeasurement - Inertias."
-		}
-		if healthPackInertias.Pitch, ok = healthPackUp.Data["pitch"].(string); ok {
-			if healthPackInertias.Pitch == "" {
-				healthPackInertias.Pitch = "empty"
-			}
-		} else {
-			return "No valid key pitch to parse in HealthPackMeasurement - Inertias."
-		}
-		if healthPackInertias.Roll, ok = healthPackUp.Data["roll"].(string); ok {
-			if healthPackInertias.Roll == "" {
-				healthPackInertias.Roll = "empty"
-			}
-		} else {
-			return "No valid key roll to parse in HealthPackMeasurement - Inertias."
-		}
-		if healthPackInertias.Yaw, ok = healthPackUp.Data["yaw"].(string); ok {
-			if healthPackInertias.Yaw == "" {
-				healthPackInertias.Yaw = "empty"
-			}
-		} else {
-			return "No valid key yaw to parse in HealthPackMeasurement - Inertias."
-		}
-
-		sb.WriteString(` `)
-		sb.WriteString(`fAccX=`)
-		sb.WriteString(healthPackInertias.FAccX)
-		sb.WriteString(`,fAccY=`)
-		sb.WriteString(healthPackInertias.FAccY)
-		sb.WriteString(`,fAccZ=`)
-		sb.WriteString(healthPackInertias.FAccZ)
-		sb.WriteString(`,accX=`)
-		sb.WriteString(healthPackInertias.AccX)
-		sb.WriteString(`,accY=`)
-		sb.WriteString(healthPackInertias.AccY)
-		sb.WriteString(`,accZ=`)
-		sb.WriteString(healthPackInertias.AccZ)
-		sb.WriteString(`,gyrX=`)
-		sb.WriteString(healthPackInertias.GyrX)
-		sb.WriteString(`,gyrY=`)
-		sb.WriteString(healthPackInertias.GyrY)
-		sb.WriteString(`,gyrZ=`)
-		sb.WriteString(healthPackInertias.GyrZ)
-		sb.WriteString(`,contimpactoX=`)
-		sb.WriteString(healthPackInertias.ContimpactoX)
-		sb.WriteString(`,contimpactoY=`)
-		sb.WriteString(healthPackInertias.ContimpactoY)
-		sb.WriteString(`,contimpactoZ=`)
-		sb.WriteString(healthPackInertias.ContimpactoZ)
-		sb.WriteString(`,pitch=`)
-		sb.WriteString(healthPackInertias.Pitch)
-		sb.WriteString(`,roll=`)
-		sb.WriteString(healthPackInertias.Roll)
-		sb.WriteString(`,yaw=`)
-		sb.WriteString(healthPackInertias.Yaw)
-
-	case "Tracking":
-		var healthPackTracking HealthPackTracking
-		json.Unmarshal([]byte(data), &healthPackTracking)
-
-		if healthPackTracking.Latitude, ok = healthPackUp.Data["latitude"].(string); ok {
-			if healthPackTracking.Latitude == "" {
-				healthPackTracking.Latitude = "empty"
-			}
-		} else {
-			return "No valid key latitude to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Longitude, ok = healthPackUp.Data["longitude"].(string); ok {
-			if healthPackTracking.Longitude == "" {
-				healthPackTracking.Longitude = "empty"
-			}
-		} else {
-			return "No valid key longitude to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Tempbateriasecundaria, ok = healthPackUp.Data["tempbateriasecundaria"].(string); ok {
-			if healthPackTracking.Tempbateriasecundaria == "" {
-				healthPackTracking.Tempbateriasecundaria = "empty"
-			}
-		} else {
-			return "No valid key tempbateriasecundaria to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Tempbateriaprincipal, ok = healthPackUp.Data["tempbateriaprincipal"].(string); ok {
-			if healthPackTracking.Tempbateriaprincipal == "" {
-				healthPackTracking.Tempbateriaprincipal = "empty"
-			}
-		} else {
-			return "No valid key tempbateriaprincipal to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Temperaturacondensador, ok = healthPackUp.Data["temperaturacondensador"].(string); ok {
-			if healthPackTracking.Temperaturacondensador == "" {
-				healthPackTracking.Temperaturacondensador = "empty"
-			}
-		} else {
-			return "No valid key temperaturacondensador to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Temperaturacuba1, ok = healthPackUp.Data["temperaturacuba1"].(string); ok {
-			if healthPackTracking.Temperaturacuba1 == "" {
-				healthPackTracking.Temperaturacuba1 = "empty"
-			}
-		} else {
-			return "No valid key temperaturacuba1 to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Temperaturacuba2, ok = healthPackUp.Data["temperaturacuba2"].(string); ok {
-			if healthPackTracking.Temperaturacuba2 == "" {
-				healthPackTracking.Temperaturacuba2 = "empty"
-			}
-		} else {
-			return "No valid key temperaturacuba2 to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.TemperaturaexternaLL, ok = healthPackUp.Data["temperaturaexternaLL"].(string); ok {
-			if healthPackTracking.TemperaturaexternaLL == "" {
-				healthPackTracking.TemperaturaexternaLL = "empty"
-			}
-		} else {
-			return "No valid key temperaturaexternaLL to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.TemperaturaexternaLS, ok = healthPackUp.Data["temperaturaexternaLS"].(string); ok {
-			if healthPackTracking.TemperaturaexternaLS == "" {
-				healthPackTracking.TemperaturaexternaLS = "empty"
-			}
-		} else {
-			return "No valid key temperaturaexternaLS to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Temperaturaexterna, ok = healthPackUp.Data["temperaturaexterna"].(string); ok {
-			if healthPackTracking.Temperaturaexterna == "" {
-				healthPackTracking.Temperaturaexterna = "empty"
-			}
-		} else {
-			return "No valid key temperaturaexterna to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Temperaturadissipador, ok = healthPackUp.Data["temperaturadissipador"].(string); ok {
-			if healthPackTracking.Temperaturadissipador == "" {
-				healthPackTracking.Temperaturadissipador = "empty"
-			}
-		} else {
-			return "No valid key temperaturadissipador to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Correntebateria, ok = healthPackUp.Data["correntebateria"].(string); ok {
-			if healthPackTracking.Correntebateria == "" {
-				healthPackTracking.Correntebateria = "empty"
-			}
-		} else {
-			return "No valid key correntebateria to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Correntecompressor, ok = healthPackUp.Data["correntecompressor"].(string); ok {
-			if healthPackTracking.Correntecompressor == "" {
-				healthPackTracking.Correntecompressor = "empty"
-			}
-		} else {
-			return "No valid key correntecompressor to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Correntepeltier, ok = healthPackUp.Data["correntepeltier"].(string); ok {
-			if healthPackTracking.Correntepeltier == "" {
-				healthPackTracking.Correntepeltier = "empty"
-			}
-		} else {
-			return "No valid key correntepeltier to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Correntecooler, ok = healthPackUp.Data["correntecooler"].(string); ok {
-			if healthPackTracking.Correntecooler == "" {
-				healthPackTracking.Correntecooler = "empty"
-			}
-		} else {
-			return "No valid key correntecooler to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Correnteexaustor, ok = healthPackUp.Data["correnteexaustor"].(string); ok {
-			if healthPackTracking.Correnteexaustor == "" {
-				healthPackTracking.Correnteexaustor = "empty"
-			}
-		} else {
-			return "No valid key correnteexaustor to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Temperaturacompressor, ok = healthPackUp.Data["temperaturacompressor"].(string); ok {
-			if healthPackTracking.Temperaturacompressor == "" {
-				healthPackTracking.Temperaturacompressor = "empty"
-			}
-		} else {
-			return "No valid key temperaturacompressor to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Setpoint_pid1, ok = healthPackUp.Data["setpoint_pid1"].(string); ok {
-			if healthPackTracking.Setpoint_pid1 == "" {
-				healthPackTracking.Setpoint_pid1 = "empty"
-			}
-		} else {
-			return "No valid key setpoint_pid1 to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Valor_pid1_atual, ok = healthPackUp.Data["valor_pid1_atual"].(string); ok {
-			if healthPackTracking.Valor_pid1_atual == "" {
-				healthPackTracking.Valor_pid1_atual = "empty"
-			}
-		} else {
-			return "No valid key valor_pid1_atual to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Esforco_pid1, ok = healthPackUp.Data["esforco_pid1"].(string); ok {
-			if healthPackTracking.Esforco_pid1 == "" {
-				healthPackTracking.Esforco_pid1 = "empty"
-			}
-		} else {
-			return "No valid key esforco_pid1 to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Setpoint_pid2, ok = healthPackUp.Data["setpoint_pid2"].(string); ok {
-			if healthPackTracking.Setpoint_pid2 == "" {
-				healthPackTracking.Setpoint_pid2 = "empty"
-			}
-		} else {
-			return "No valid key setpoint_pid2 to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Valor_pid2_atual, ok = healthPackUp.Data["valor_pid2_atual"].(string); ok {
-			if healthPackTracking.Valor_pid2_atual == "" {
-				healthPackTracking.Valor_pid2_atual = "empty"
-			}
-		} else {
-			return "No valid key valor_pid2_atual to parse in HealthPackMeasurement - Tracking."
-		}
-		if healthPackTracking.Esforco_pid2, ok = healthPackUp.Data["esforco_pid2"].(string); ok {
-			if healthPackTracking.Esforco_pid2 == "" {
-				healthPackTracking.Esforco_pid2 = "empty"
-			}
-		} else {
-			return "No valid key esforco_pid2 to parse in HealthPackMeasurement - Tracking."
-		}
-
-		sb.WriteString(` `)
-		sb.WriteString(`latitude=`)
-		sb.WriteString(healthPackTracking.Latitude)
-		sb.WriteString(`,longitude=`)
-		sb.WriteString(healthPackTracking.Longitude)
-		sb.WriteString(`,tempbateriasecundaria=`)
-		sb.WriteString(healthPackTracking.Tempbateriasecundaria)
-		sb.WriteString(`,tempbateriaprincipal=`)
-		sb.WriteString(healthPackTracking.Tempbateriaprincipal)
-		sb.WriteString(`,temperaturacondensador=`)
-		sb.WriteString(healthPackTracking.Temperaturacondensador)
-		sb.WriteString(`,temperaturacuba1=`)
-		sb.WriteString(healthPackTracking.Temperaturacuba1)
-		sb.WriteString(`,temperaturacuba2=`)
-		sb.WriteString(healthPackTracking.Temperaturacuba2)
-		sb.WriteString(`,temperaturaexternaLL=`)
-		sb.WriteString(healthPackTracking.TemperaturaexternaLL)
-		sb.WriteString(`,temperaturaexternaLS=`)
-		sb.WriteString(healthPackTracking.TemperaturaexternaLS)
-		sb.WriteString(`,temperaturaexterna=`)
-		sb.WriteString(healthPackTracking.Temperaturaexterna)
-		sb.WriteString(`,temperaturadissipador=`)
-		sb.WriteString(healthPackTracking.Temperaturadissipador)
-		sb.WriteString(`,correntebateria=`)
-		sb.WriteString(healthPackTracking.Correntebateria)
-		sb.WriteString(`,correntecompressor=`)
-		sb.WriteString(healthPackTracking.Correntecompressor)
-		sb.WriteString(`,correntepeltier=`)
-		sb.WriteString(healthPackTracking.Correntepeltier)
-		sb.WriteString(`,correntecooler=`)
-		sb.WriteString(healthPackTracking.Correntecooler)
-		sb.WriteString(`,correnteexaustor=`)
-		sb.WriteString(healthPackTracking.Correnteexaustor)
-		sb.WriteString(`,temperaturacompressor=`)
-		sb.WriteString(healthPackTracking.Temperaturacompressor)
-		sb.WriteString(`,setpoint_pid1=`)
-		sb.WriteString(healthPackTracking.Setpoint_pid1)
-		sb.WriteString(`,valor_pid1_atual=`)
-		sb.WriteString(healthPackTracking.Valor_pid1_atual)
-		sb.WriteString(`,esforco_pid1=`)
-		sb.WriteString(healthPackTracking.Esforco_pid1)
-		sb.WriteString(`,setpoint_pid2=`)
-		sb.WriteString(healthPackTracking.Setpoint_pid2)
-		sb.WriteString(`,valor_pid2_atual=`)
-		sb.WriteString(healthPackTracking.Valor_pid2_atual)
-		sb.WriteString(`,esforco_pid2=`)
-		sb.WriteString(healthPackTracking.Esforco_pid2)
+	case "Inertias", "Tracking":
+		sb.WriteString(healthPackFields(measurement, healthPackUp.Data))
 
 	case "Status":
-		var healthPackStatus HealthPackStatus
-		json.Unmarshal([]byte(data), &healthPackStatus)
-
-		if healthPackStatus.Vbateriaprincipal, ok = healthPackUp.Data["vbateriaprincipal"].(string); ok {
-			if healthPackStatus.Vbateriaprincipal == "" {
-				healthPackStatus.Vbateriaprincipal = "empty"
-			}
-		} else {
-			return "No valid key vbateriaprincipal to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Vbateriasecundaria, ok = healthPackUp.Data["vbateriasecundaria"].(string); ok {
-			if healthPackStatus.Vbateriasecundaria == "" {
-				healthPackStatus.Vbateriasecundaria = "empty"
-			}
-		} else {
-			return "No valid key vbateriasecundaria to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Ventradafonteexterna, ok = healthPackUp.Data["ventradafonteexterna"].(string); ok {
-			if healthPackStatus.Ventradafonteexterna == "" {
-				healthPackStatus.Ventradafonteexterna = "empty"
-			}
-		} else {
-			return "No valid key ventradafonteexterna to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Numerocaixa, ok = healthPackUp.Data["numerocaixa"].(string); ok {
-			if healthPackStatus.Numerocaixa == "" {
-				healthPackStatus.Numerocaixa = "empty"
-			}
-		} else {
-			return "No valid key numerocaixa to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Estadomaquina, ok = healthPackUp.Data["estadomaquina"].(string); ok {
-			if healthPackStatus.Estadomaquina == "" {
-				healthPackStatus.Estadomaquina = "empty"
-			}
-		} else {
-			return "No valid key estadomaquina to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Timestamp, ok = healthPackUp.Data["timestamp"].(string); ok {
-			if healthPackStatus.Timestamp == "" {
-				healthPackStatus.Timestamp = "empty"
-			}
-		} else {
-			return "No valid key timestamp to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.IdFalha, ok = healthPackUp.Data["idFalha"].(string); ok {
-			if healthPackStatus.IdFalha == "" {
-				healthPackStatus.IdFalha = "empty"
-			}
-		} else {
-			return "No valid key idFalha to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Porcentagemsinalcomunicacao, ok = healthPackUp.Data["porcentagemsinalcomunicacao"].(string); ok {
-			if healthPackStatus.Porcentagemsinalcomunicacao == "" {
-				healthPackStatus.Porcentagemsinalcomunicacao = "empty"
-			}
-		} else {
-			return "No valid key porcentagemsinalcomunicacao to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.FatorRH, ok = healthPackUp.Data["fatorRH"].(string); ok {
-			if healthPackStatus.FatorRH == "" {
-				healthPackStatus.FatorRH = "empty"
-			}
-		} else {
-			return "No valid key fatorRH to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Btdown, ok = healthPackUp.Data["btdown"].(string); ok {
-			if healthPackStatus.Btdown == "" {
-				healthPackStatus.Btdown = "empty"
-			}
-		} else {
-			return "No valid key btdown to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Btselect, ok = healthPackUp.Data["btselect"].(string); ok {
-			if healthPackStatus.Btselect == "" {
-				healthPackStatus.Btselect = "empty"
-			}
-		} else {
-			return "No valid key btselect to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Btup, ok = healthPackUp.Data["btup"].(string); ok {
-			if healthPackStatus.Btup == "" {
-				healthPackStatus.Btup = "empty"
-			}
-		} else {
-			return "No valid key btup to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Tecla_enter, ok = healthPackUp.Data["tecla_enter"].(string); ok {
-			if healthPackStatus.Tecla_enter == "" {
-				healthPackStatus.Tecla_enter = "empty"
-			}
-		} else {
-			return "No valid key tecla_enter to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Statustampaprincipal, ok = healthPackUp.Data["statustampaprincipal"].(string); ok {
-			if healthPackStatus.Statustampaprincipal == "" {
-				healthPackStatus.Statustampaprincipal = "empty"
-			}
-		} else {
-			return "No valid key statustampaprincipal to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Statustampaprincipal, ok = healthPackUp.Data["statustampaprincipal"].(string); ok {
-			if healthPackStatus.Statustampaprincipal == "" {
-				healthPackStatus.Statustampaprincipal = "empty"
-			}
-		} else {
-			return "No valid key statustampaprincipal to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Statusserialprincipal, ok = healthPackUp.Data["statusserialprincipal"].(string); ok {
-			if healthPackStatus.Statusserialprincipal == "" {
-				healthPackStatus.Statusserialprincipal = "empty"
-			}
-		} else {
-			return "No valid key statusserialprincipal to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Statusserialsecundaria, ok = healthPackUp.Data["statusserialsecundaria"].(string); ok {
-			if healthPackStatus.Statusserialsecundaria == "" {
-				healthPackStatus.Statusserialsecundaria = "empty"
-			}
-		} else {
-			return "No valid key statusserialsecundaria to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Statustampacasamaq, ok = healthPackUp.Data["statustampacasamaq"].(string); ok {
-			if healthPackStatus.Statustampacasamaq == "" {
-				healthPackStatus.Statustampacasamaq = "empty"
-			}
-		} else {
-			return "No valid key statustampacasamaq to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Controle_peltier, ok = healthPackUp.Data["controle_peltier"].(string); ok {
-			if healthPackStatus.Controle_peltier == "" {
-				healthPackStatus.Controle_peltier = "empty"
-			}
-		} else {
-			return "No valid key controle_peltier to parse in HealthPackMeasurement - Status."
-		}
-		if healthPackStatus.Porcentagem_bat, ok = healthPackUp.Data["porcentagem_bat"].(string); ok {
-			if healthPackStatus.Porcentagem_bat == "" {
-				healthPackStatus.Porcentagem_bat = "empty"
-			}
-		} else {
-			return "No valid key porcentagem_bat to parse in HealthPackMeasurement - Status."
+		if fields := healthPackFields(measurement, healthPackUp.Data); fields != "" {
+			sb.WriteString(healthPackStatusTags(healthPackUp.Data))
+			sb.WriteString(fields)
 		}
 
-		sb.WriteString(` `)
-		sb.WriteString(`vbateriaprincipal=`)
-		sb.WriteString(healthPackStatus.Vbateriaprincipal)
-		sb.WriteString(`,vbateriasecundaria=`)
-		sb.WriteString(healthPackStatus.Vbateriasecundaria)
-		sb.WriteString(`,ventradafonteexterna=`)
-		sb.WriteString(healthPackStatus.Ventradafonteexterna)
-		sb.WriteString(`,numerocaixa=`)
-		sb.WriteString(healthPackStatus.Numerocaixa)
-		sb.WriteString(`,estadomaquina=`)
-		sb.WriteString(healthPackStatus.Estadomaquina)
-		sb.WriteString(`,timestamp=`)
-		sb.WriteString(healthPackStatus.Timestamp)
-		sb.WriteString(`,idFalha=`)
-		sb.WriteString(healthPackStatus.IdFalha)
-		sb.WriteString(`,porcentagemsinalcomunicacao=`)
-		sb.WriteString(healthPackStatus.Porcentagemsinalcomunicacao)
-		sb.WriteString(`,fatorRH=`)
-		sb.WriteString(healthPackStatus.FatorRH)
-		sb.WriteString(`,btdown=`)
-		sb.WriteString(healthPackStatus.Btdown)
-		sb.WriteString(`,btselect=`)
-		sb.WriteString(healthPackStatus.Btselect)
-		sb.WriteString(`,btup=`)
-		sb.WriteString(healthPackStatus.Btup)
-		sb.WriteString(`,tecla_enter=`)
-		sb.WriteString(healthPackStatus.Tecla_enter)
-		sb.WriteString(`,statustampaprincipal=`)
-		sb.WriteString(healthPackStatus.Statustampaprincipal)
-		sb.WriteString(`,statusserialprincipal=`)
-		sb.WriteString(healthPackStatus.Statusserialprincipal)
-		sb.WriteString(`,statusserialsecundaria=`)
-		sb.WriteString(healthPackStatus.Statusserialsecundaria)
-		sb.WriteString(`,statustampacasamaq=`)
-		sb.WriteString(healthPackStatus.Statustampacasamaq)
-		sb.WriteString(`,controle_peltier=`)
-		sb.WriteString(healthPackStatus.Controle_peltier)
-		sb.WriteString(`,porcentagem_bat=`)
-		sb.WriteString(healthPackStatus.Porcentagem_bat)
-
 	case "Ischemia":
-		var healthPackIschemia HealthPackIschemia
-		json.Unmarshal([]byte(data), &healthPackIschemia)
-
-		if healthPackIschemia.IdModal, ok = healthPackUp.Data["idModal"].(string); ok {
-			if healthPackIschemia.IdModal == "" {
-				healthPackIschemia.IdModal = "empty"
-			}
-		} else {
-			return "No valid key to parse in HealthPackMeasurement - Ischemia."
-		}
-		if healthPackIschemia.IdOperador, ok = healthPackUp.Data["IdOperador"].(string); ok {
-			if healthPackIschemia.IdOperador == "" {
-				healthPackIschemia.IdOperador = "empty"
-			}
-		} else {
-			return "No valid key to parse in HealthPackMeasurement - Ischemia."
-		}
-		if healthPackIschemia.Niveldepermissao, ok = healthPackUp.Data["niveldepermissao"].(string); ok {
-			if healthPackIschemia.Niveldepermissao == "" {
-				healthPackIschemia.Niveldepermissao = "empty"
-			}
-		} else {
-			return "No valid key to parse in HealthPackMeasurement - Ischemia."
-		}
-		if healthPackIschemia.Nome, ok = healthPackUp.Data["nome"].(string); ok {
-			if healthPackIschemia.Nome == "" {
-				healthPackIschemia.Nome = "empty"
-			}
-		} else {
-			return "No valid key to parse in HealthPackMeasurement - Ischemia."
-		}
-		if healthPackIschemia.Numtransplante, ok = healthPackUp.Data["numtransplante"].(string); ok {
-			if healthPackIschemia.Numtransplante == "" {
-				healthPackIschemia.Numtransplante = "empty"
-			}
-		} else {
-			return "No valid key to parse in HealthPackMeasurement - Ischemia."
-		}
-		if healthPackIschemia.Numeroempresa, ok = healthPackUp.Data["numeroempresa"].(string); ok {
-			if healthPackIschemia.Numeroempresa == "" {
-				healthPackIschemia.Numeroempresa = "empty"
-			}
-		} else {
-			return "No valid key to parse in HealthPackMeasurement - Ischemia."
-		}
-		if healthPackIschemia.Orgao, ok = healthPackUp.Data["orgao"].(string); ok {
-			if healthPackIschemia.Orgao == "" {
-				healthPackIschemia.Orgao = "empty"
-			}
-		} else {
-			return "No valid key to parse in HealthPackMeasurement - Ischemia."
-		}
-		if healthPackIschemia.Tempo_total_isquemia, ok = healthPackUp.Data["tempo_total_isquemia"].(string); ok {
-			if healthPackIschemia.Tempo_total_isquemia == "" {
-				healthPackIschemia.Tempo_total_isquemia = "Tempo_total_isquemia"
-			}
-		} else {
-			return "No valid key to parse in HealthPackMeasurement - Ischemia."
-		}
-		if healthPackIschemia.Tempo_restante_isquemia, ok = healthPackUp.Data["tempo_restante_isquemia"].(string); ok {
-			if healthPackIschemia.Tempo_restante_isquemia == "" {
-				healthPackIschemia.Tempo_restante_isquemia = "Tempo_restante_isquemia"
-			}
-		} else {
-			return "No valid key to parse in HealthPackMeasurement - Ischemia."
-		}
-		if healthPackIschemia.Hora_isquemia, ok = healthPackUp.Data["hora_isquemia"].(string); ok {
-			if healthPackIschemia.Hora_isquemia == "" {
-				healthPackIschemia.Hora_isquemia = "empty"
-			}
-		} else {
-			return "No valid key to parse in HealthPackMeasurement - Ischemia."
-		}
-		if healthPackIschemia.Timeinfo_sp2, ok = healthPackUp.Data["timeinfo_sp2"].(string); ok {
-			if healthPackIschemia.Timeinfo_sp2 == "" {
-				healthPackIschemia.Timeinfo_sp2 = "empty"
-			}
-		} else {
-			return "No valid key to parse in HealthPackMeasurement - Ischemia."
-		}
-
-		// sb.WriteString(` `)
-		// sb.WriteString(`idModal=`)
-		// sb.WriteString(healthPackIschemia.IdModal)
-		// sb.WriteString(`,IdOperador=`)
-		// sb.WriteString(healthPackIschemia.IdOperador)
-		// sb.WriteString(`,niveldepermissao=`)
-		// sb.WriteString(healthPackIschemia.Niveldepermissao)
-		// sb.WriteString(`,nome=`)
-		// sb.WriteString(healthPackIschemia.Nome)
-		// sb.WriteString(`,numtransplante=`)
-		// sb.WriteString(healthPackIschemia.Numtransplante)
-		// sb.WriteString(`,numeroempresa=`)
-		// sb.WriteString(healthPackIschemia.Numeroempresa)
-		// sb.WriteString(`,orgao=`)
-		// sb.WriteString(healthPackIschemia.Orgao)
-		// sb.WriteString(`,tempo_total_isquemia=`)
-		// sb.WriteString(healthPackIschemia.Tempo_total_isquemia)
-		// sb.WriteString(`,tempo_restante_isquemia=`)
-		// sb.WriteString(healthPackIschemia.Tempo_restante_isquemia)
-		// sb.WriteString(`,hora_isquemia=`)
-		// sb.WriteString(healthPackIschemia.Hora_isquemia)
-		// sb.WriteString(`,timeinfo_sp2=`)
-		// sb.WriteString(healthPackIschemia.Timeinfo_sp2)
-
-		// case "Alarm":
-		// 	var healthPackAlarm HealthPackAlarm
-		// 	json.Unmarshal([]byte(data), &healthPackAlarm)
-
-		// // TODO: Verify if alarm is not nil, then poarse it!
-		// sb.WriteString(`,alarms=`)
-		// sb.WriteString(healthPackAlarm.Alarms)
+		sb.WriteString(healthPackIschemiaFields(healthPackUp.Data))
 
+	case "Alarm":
+		sb.WriteString(healthPackAlarmFields(healthPackUp.Data))
 	}
 
 	return sb.String()
 }
 
-func parseHealthPack(measurement string, deviceType string, deviceId string, direction string, etc string, message string) string {
+func parseHealthPack(organization string, measurement string, deviceType string, deviceId string, direction string, etc string, message string) string {
 	var sb strings.Builder
 	var healthPackUp HealthPackUp
 	var healthPackUpProps HealthPackUpProps
 
-	// TODO: SET ALL TIMES TO TIMESTAMP IN NS
-
 	if message == "" {
 		return "No message to parse"
 	}
 
 	if direction == "up" {
-		var setUTC strings.Builder
+		received := time.Now()
 
 		// JSON to healthPackUp struct
 		json.Unmarshal([]byte(message), &healthPackUp)
@@ -2768,42 +2012,54 @@ func parseHealthPack(measurement string, deviceType string, deviceId string, dir
 		healthPackUpProps.DeviceIp = healthPackUp.Props.DeviceIp
 		healthPackUpProps.MacAddress = healthPackUp.Props.MacAddress
 
+		location := deviceLocation(organization, healthPackTimeZone, deviceId, deviceType)
+		t, timeSource, clockSkew, parsed := healthPackTime(healthPackUp.Date, location, received)
+
 		sb.WriteString(measurement)
 
 		// Tags
-		sb.WriteString(`,deviceId=`)
-		sb.WriteString(healthPackUpProps.DeviceName)
+		writeTag(&sb, "deviceId", healthPackUpProps.DeviceName)
 		sb.WriteString(`,deviceType=`)
 		sb.WriteString(deviceType)
-		sb.WriteString(`,macAddress=`)
-		sb.WriteString(healthPackUpProps.MacAddress)
-		sb.WriteString(`,deviceIp=`)
-		sb.WriteString(healthPackUpProps.DeviceIp)
+		writeTag(&sb, "macAddress", healthPackUpProps.MacAddress)
+		writeTag(&sb, "deviceIp", healthPackUpProps.DeviceIp)
 
 		sb.WriteString(`,direction=`)
 		sb.WriteString(direction)
 		sb.WriteString(`,origin=`)
 		sb.WriteString(etc)
+		sb.WriteString(`,timeSource=`)
+		sb.WriteString(timeSource)
 
-		// Fields
-		sb.WriteString(parseHealthPackMeasurement(measurement, message))
+		// Measurement tags and fields, a record without fields is dropped
+		fields := parseHealthPackMeasurement(measurement, message)
+		if fields == "" {
+			return ""
+		}
+		sb.WriteString(fields)
+		if parsed {
+			sb.WriteString(`,clockSkew=`)
+			sb.WriteString(strconv.FormatFloat(clockSkew.Seconds(), 'f', 3, 64))
+		}
 
 		// Timestamp_ns
 		sb.WriteString(` `)
+		sb.WriteString(strconv.FormatInt(t.UnixNano(), 10))
 
-		dateString := healthPackUp.Date
-		setUTC.WriteString("20")
-		setUTC.WriteString(dateString)
-		setUTC.WriteString(" -0300")
-
-		layout := "2006:01:02 15:04:05 -0700"
-
-		t, err := time.Parse(layout, setUTC.String())
-		if err != nil {
-			fmt.Println("Error parsing date:", err)
+		switch measurement {
+		case "Alarm":
+			emitHealthPackAlarms(sb.String(), fields, deviceType, etc, received)
+		case "Ischemia":
+			checkIschemia(sb.String(), deviceType, etc, received)
+			trackTransport(sb.String(), deviceType, etc, received)
+		case "Tracking":
+			tracking := enrichPosition(sb.String(), "latitude", "longitude", deviceType, etc, received)
+			trackColdChain(tracking, received)
+			sb.Reset()
+			sb.WriteString(tracking)
+		case "Status":
+			trackHealthPackState(sb.String(), deviceType, etc, received)
 		}
-
-		sb.WriteString(strconv.FormatInt(t.UnixNano(), 10))
 	}
 
 	return sb.String()
@@ -2818,13 +2074,7 @@ func parseNspiMeasurement(measurement string, data string) string {
 
 	switch measurement {
 	case "GenericJson":
-		var nspiGenericJson NspiGenericJson
-		json.Unmarshal([]byte(data), &nspiGenericJson)
-
-		// TODO -> Assign strings to Tags and not strings into fields
-		sb.WriteString(` `)
-		sb.WriteString(`data=`)
-		sb.WriteString(nspiGenericJson.Data)
+		sb.WriteString(nspiGenericJsonFields(data))
 	}
 
 	return sb.String()
@@ -2839,12 +2089,15 @@ func parseNspi(measurement string, deviceType string, deviceId string, direction
 	}
 
 	if direction == "up" {
-		var measurement strings.Builder
-
 		json.Unmarshal([]byte(message), &nspiUp)
 
+		fields := parseNspiMeasurement(measurement, message)
+		if fields == "" {
+			return ""
+		}
+
 		// Measurement
-		sb.WriteString(measurement.String())
+		sb.WriteString(measurement)
 
 		// Tags
 		sb.WriteString(`,deviceId=`)
@@ -2874,7 +2127,7 @@ func parseNspi(measurement string, deviceType string, deviceId string, direction
 		// Fields
 		// sb.WriteString(`,fowardEnergy=`)
 		// sb.WriteString(strconv.FormatUint(evseUp.FowardEnergy, 10))
-		sb.WriteString(parseNspiMeasurement(measurement.String(), message))
+		sb.WriteString(fields)
 
 		// Timestamp_ns
 		sb.WriteString(` `)
@@ -2902,15 +2155,19 @@ func main() {
 	sbMqttSubClientId.WriteString(id)
 
 	// MqttSubscriberTopic
-	var sbMqttSubTopic strings.Builder
-	// sbMqttSubTopic.WriteString("debug/OpenDataTelemetry/")
-	sbMqttSubTopic.WriteString("OpenDataTelemetry/")
-	// sbMqttSubTopic.WriteString(ORGANIZATION)
-	// sbMqttSubTopic.WriteString("/")
-	// sbMqttSubTopic.WriteString(DEVICE_TYPE)
-	sbMqttSubTopic.WriteString("+/+/+/+/+/+")
-	// sbMqttSubTopic.WriteString("#")
-	// sbMqttSubTopic.WriteString("/+/+/+")
+	// MQTT_TOPIC_LAYOUT=debug/OpenDataTelemetry/{organization}/{deviceType}/{measurement}/{deviceId}/{direction}/{etc}
+	topicLayout, err := newTopicLayout(getEnv("MQTT_TOPIC_LAYOUT", defaultTopicLayout))
+	if err != nil {
+		panic(err)
+	}
+	mqttSubQos, err := strconv.ParseUint(getEnv("MQTT_SUB_QOS", "1"), 10, 8)
+	if err != nil || mqttSubQos > 2 {
+		panic(fmt.Errorf("invalid MQTT_SUB_QOS %q", os.Getenv("MQTT_SUB_QOS")))
+	}
+	mqttSubscriptions, err := parseSubscriptions(getEnv("MQTT_SUB_TOPICS", topicLayout.Filter()), byte(mqttSubQos), os.Getenv("MQTT_SHARE_GROUP"))
+	if err != nil {
+		panic(err)
+	}
 
 	// KafkaProducerClient
 	var sbKafkaProdClientId strings.Builder
@@ -2919,10 +2176,14 @@ func main() {
 
 	// MQTT
 	mqttSubBroker := MQTT_BROKER
-	mqttSubClientId := sbMqttSubClientId.String()
-	mqttSubUser := "public"
-	mqttSubPassword := "public"
-	mqttSubQos := 0
+	// A stable MQTT_CLIENT_ID is required for the broker to keep the session across restarts
+	mqttSubClientId := getEnv("MQTT_CLIENT_ID", sbMqttSubClientId.String())
+	mqttSubCleanSession := getEnvBool("MQTT_CLEAN_SESSION", false)
+	if !mqttSubCleanSession && os.Getenv("MQTT_CLIENT_ID") == "" {
+		fmt.Println("MQTT_CLIENT_ID is not set, unacknowledged messages will not be redelivered after a restart")
+	}
+	mqttSubUser := getSecret("MQTT_USERNAME", "public")
+	mqttSubPassword := getSecret("MQTT_PASSWORD", "public")
 
 	mqttSubOpts := MQTT.NewClientOptions()
 	mqttSubOpts.AddBroker(mqttSubBroker)
@@ -2930,11 +2191,22 @@ func main() {
 	mqttSubOpts.SetUsername(mqttSubUser)
 	mqttSubOpts.SetPassword(mqttSubPassword)
 	mqttSubOpts.SetConnectionLostHandler(connLostHandler)
+	// Messages are acknowledged only after Kafka confirms the delivery
+	mqttSubOpts.SetAutoAckDisabled(true)
+	mqttSubOpts.SetCleanSession(mqttSubCleanSession)
 
-	c := make(chan [2]string)
+	mqttTLS, err := mqttTLSConfig()
+	if err != nil {
+		panic(err)
+	}
+	if mqttTLS != nil {
+		mqttSubOpts.SetTLSConfig(mqttTLS)
+	}
+
+	c := make(chan MQTT.Message)
 
 	mqttSubOpts.SetDefaultPublishHandler(func(mqttClient MQTT.Client, msg MQTT.Message) {
-		c <- [2]string{msg.Topic(), string(msg.Payload())}
+		c <- msg
 	})
 
 	mqttSubClient := MQTT.NewClient(mqttSubOpts)
@@ -2944,19 +2216,65 @@ func main() {
 		fmt.Printf("Connected to %s\n", mqttSubBroker)
 	}
 
-	if token := mqttSubClient.Subscribe(sbMqttSubTopic.String(), byte(mqttSubQos), nil); token.Wait() && token.Error() != nil {
+	// EVSE commands are published on a connection of their own
+	mqttPubOpts := MQTT.NewClientOptions()
+	mqttPubOpts.AddBroker(mqttSubBroker)
+	mqttPubOpts.SetClientID(mqttSubClientId + "-pub")
+	mqttPubOpts.SetUsername(mqttSubUser)
+	mqttPubOpts.SetPassword(mqttSubPassword)
+	mqttPubOpts.SetConnectionLostHandler(connLostHandler)
+	if mqttTLS != nil {
+		mqttPubOpts.SetTLSConfig(mqttTLS)
+	}
+	evseCommandClient = MQTT.NewClient(mqttPubOpts)
+	if token := evseCommandClient.Connect(); token.Wait() && token.Error() != nil {
+		panic(token.Error())
+	}
+	evseCommandTopic = getEnv("EVSE_COMMAND_TOPIC", evseCommandTopic)
+	if qos := getEnvInt("EVSE_COMMAND_QOS", int64(evseCommandQos)); qos < 0 || qos > 2 {
+		panic(fmt.Errorf("invalid EVSE_COMMAND_QOS %d", qos))
+	} else {
+		evseCommandQos = byte(qos)
+	}
+
+	mqttSubFilters := make(map[string]byte)
+	for _, subscription := range mqttSubscriptions {
+		mqttSubFilters[subscription.Filter] = subscription.Qos
+		fmt.Printf("Subscribing to %s (QoS %d)\n", subscription.Filter, subscription.Qos)
+	}
+	if token := mqttSubClient.SubscribeMultiple(mqttSubFilters, nil); token.Wait() && token.Error() != nil {
 		fmt.Println(token.Error())
 		os.Exit(1)
 	}
 
 	// KAFKA
 	// kafkaProdClient, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": "my-cluster-kafka-bootstrap.test-kafka.svc.cluster.local"})
-	kafkaProdClient, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": kafkaBroker})
+	kafkaProdClient, err := kafka.NewProducer(kafkaConfigMap(kafkaBroker))
 	if err != nil {
 		panic(err)
 	}
 	defer kafkaProdClient.Close()
 
+	// Records that Kafka could not take are kept on disk and drained when it is reachable again
+	var buffer *DiskBuffer
+	if bufferDir := os.Getenv("BUFFER_DIR"); bufferDir != "" {
+		buffer, err = newDiskBuffer(
+			bufferDir,
+			getEnvInt("BUFFER_SEGMENT_BYTES", 16*1024*1024),
+			getEnvDuration("BUFFER_SEGMENT_AGE", time.Hour),
+			getEnvInt("BUFFER_MAX_BYTES", 1024*1024*1024),
+			getEnvDuration("BUFFER_RETENTION", 0),
+		)
+		if err != nil {
+			panic(err)
+		}
+		go drainBuffer(buffer, kafkaProdClient, getEnvDuration("BUFFER_DRAIN_INTERVAL", 10*time.Second))
+	}
+
+	if metricsAddr := os.Getenv("METRICS_ADDR"); metricsAddr != "" {
+		go serveMetrics(metricsAddr)
+	}
+
 	// Delivery report handler for produced messages
 	go func() {
 		for e := range kafkaProdClient.Events() {
@@ -2964,35 +2282,173 @@ func main() {
 			case *kafka.Message:
 				if ev.TopicPartition.Error != nil {
 					fmt.Printf("Delivery failed: %v\n", ev.TopicPartition)
+					// An unacknowledged message would hold its slot of the broker inflight window until the
+					// subscriber stalls, so without the buffer the gateway exits like produce does and the
+					// broker redelivers the message to the next session
+					if buffer == nil {
+						os.Exit(1)
+					}
+					if err := buffer.Append(*ev.TopicPartition.Topic, ev.Value); err != nil {
+						fmt.Printf("Buffering failed: %v\n", err)
+						os.Exit(1)
+					}
+					if msg, ok := ev.Opaque.(MQTT.Message); ok {
+						msg.Ack()
+					}
 				} else {
 					fmt.Printf("\nDelivered message to %v\n", ev.TopicPartition)
+					if msg, ok := ev.Opaque.(MQTT.Message); ok {
+						msg.Ack()
+					}
 				}
 			}
 		}
 	}()
 
+	if schemaFile := os.Getenv("SCHEMA_FILE"); schemaFile != "" {
+		schema, err = loadSchema(schemaFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if err := validateHealthPackSchema(); err != nil {
+		panic(err)
+	}
+	checkHealthPackCodes()
+	if err := checkJsonMappingSamples(); err != nil {
+		panic(err)
+	}
+	if err := setupPrivacy(schema.PrivacyRules); err != nil {
+		panic(err)
+	}
+
+	fCntWindow = int(getEnvInt("FCNT_WINDOW", int64(fCntWindow)))
+	livenessFactor = getEnvFloat("LIVENESS_FACTOR", livenessFactor)
+	livenessMinSamples = int(getEnvInt("LIVENESS_MIN_SAMPLES", int64(livenessMinSamples)))
+	seedLiveness(time.Now())
+	batteryTrendWindow = getEnvDuration("BATTERY_TREND_WINDOW", batteryTrendWindow)
+	kafkaAlarmTopic = getEnv("KAFKA_ALARM_TOPIC", "")
+	healthPackTimeZone = getEnv("HEALTHPACK_TIME_ZONE", healthPackTimeZone)
+	if _, err := time.LoadLocation(healthPackTimeZone); err != nil {
+		panic(err)
+	}
+	healthPackMaxClockSkew = getEnvDuration("HEALTHPACK_MAX_CLOCK_SKEW", healthPackMaxClockSkew)
+	nspiMaxDepth = int(getEnvInt("NSPI_MAX_DEPTH", int64(nspiMaxDepth)))
+	if nspiMaxDepth < 1 {
+		panic(fmt.Errorf("invalid NSPI_MAX_DEPTH %d", nspiMaxDepth))
+	}
+	nspiAllowFields = parseFieldPatterns(getEnv("NSPI_ALLOW_FIELDS", ""))
+	nspiDenyFields = parseFieldPatterns(getEnv("NSPI_DENY_FIELDS", ""))
+	for _, pattern := range append(nspiAllowFields, nspiDenyFields...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			panic(fmt.Errorf("invalid NSPI field pattern %q: %w", pattern, err))
+		}
+	}
+	chargingSessionFile = getEnv("CHARGING_SESSION_FILE", "")
+	chargingSessionMaxAge = getEnvDuration("CHARGING_SESSION_MAX_AGE", chargingSessionMaxAge)
+	if err := loadChargingSessions(); err != nil {
+		panic(err)
+	}
+	transportFile = getEnv("TRANSPORT_FILE", "")
+	if err := loadTransports(); err != nil {
+		panic(err)
+	}
+
+	if dedupWindow := getEnvDuration("DEDUP_WINDOW", time.Minute); dedupWindow > 0 {
+		lnsDedup = newDedupCache(dedupWindow)
+		evseCommandDedup = newDedupCache(dedupWindow)
+	}
+
+	// SET KAFKA
+	// KafkaProducerClient
+	var sbKafkaProdTopic strings.Builder
+	// TODO : parse by ORGANIZATION
+	// sbKafkaProdTopic.WriteString(organization)
+	sbKafkaProdTopic.WriteString("IMT")
+	sbKafkaProdTopic.WriteString(".")
+	sbKafkaProdTopic.WriteString(BUCKET)
+	kafkaProdTopic := sbKafkaProdTopic.String()
+
+	// produce sends value to Kafka. msg, when given, is acknowledged once the delivery succeeds.
+	// While older records wait in the buffer, value is appended behind them so that Kafka gets
+	// the records in order.
+	produce := func(kafkaProdTopic string, value string, msg MQTT.Message) {
+		var err error
+		if buffer == nil || buffer.Depth() == 0 {
+			err = kafkaProdClient.Produce(&kafka.Message{
+				TopicPartition: kafka.TopicPartition{Topic: &kafkaProdTopic, Partition: kafka.PartitionAny},
+				Value:          []byte(value),
+				Headers:        kafkaHeaders,
+				Opaque:         msg,
+			}, nil)
+			if err == nil {
+				return
+			}
+			fmt.Printf("Produce failed: %v\n", err)
+			if buffer == nil {
+				os.Exit(1)
+			}
+		}
+		if err := buffer.Append(kafkaProdTopic, []byte(value)); err != nil {
+			fmt.Printf("Buffering failed: %v\n", err)
+			os.Exit(1)
+		}
+		if msg != nil {
+			msg.Ack()
+		}
+	}
+
+	// Records derived while parsing, e.g. link quality and alerts
+	flushRecords := func() {
+		for _, record := range pendingRecords {
+			if record.Topic == "" {
+				record.Topic = kafkaProdTopic
+			}
+			if value := applyPrivacy(record.Value); value != "" {
+				produce(record.Topic, value, nil)
+			}
+		}
+		pendingRecords = pendingRecords[:0]
+	}
+
+	livenessTicker := time.NewTicker(getEnvDuration("LIVENESS_CHECK_INTERVAL", time.Minute))
+	defer livenessTicker.Stop()
+
 	// MQTT -> KAFKA
 	for {
 		// 1. Input
-		incoming := <-c
+		var msg MQTT.Message
+		select {
+		case msg = <-c:
+		case now := <-livenessTicker.C:
+			checkLiveness(now)
+			expireChargingSessions(now)
+			flushTransports()
+			flushRecords()
+			continue
+		case record := <-evseCommandResults:
+			emitRecord(record)
+			flushRecords()
+			continue
+		}
+		incoming := [2]string{msg.Topic(), string(msg.Payload())}
 
 		// 2. Process
 		// 2.1. Process Topic
-		s := strings.Split(incoming[0], "/")
 		// OpenDataTelemetry/IMT/LNS/MEASUREMENT/DEVICE_ID/up/imt
 		// OpenDataTelemetry/IMT/LNS/MEASUREMENT/DEVICE_ID/down/chirpstackv4
-		organization := s[1]
-		deviceType := s[2]
-		measurement := s[3]
-		deviceId := s[4]
-		direction := s[5]
-		etc := s[6]
-
-		// // DEBUG
-		// measurement := s[4]
-		// deviceId := s[5]
-		// direction := s[6]
-		// etc := s[7]
+		topic, ok := topicLayout.Parse(incoming[0])
+		if !ok {
+			fmt.Printf("\nTopic %s does not match layout %s\n", incoming[0], strings.Join(topicLayout.Segments, "/"))
+			msg.Ack()
+			continue
+		}
+		organization := topic.Organization
+		deviceType := topic.DeviceType
+		measurement := topic.Measurement
+		deviceId := topic.DeviceId
+		direction := topic.Direction
+		etc := topic.Etc
 
 		var kafkaMessage string
 
@@ -3008,56 +2464,65 @@ func main() {
 		// evse_startTransaction, raw= timestamp_ms
 		// evse_heartbeat, raw= timestamp_ms
 
-		switch organization {
-		case "IMT":
-			switch deviceType {
-			case "LNS":
-				kafkaMessage = parseLns(measurement, deviceId, direction, etc, incoming[1])
+		// Device families mapped in SCHEMA_FILE take precedence over the built in decoders
+		if mapping := findJsonMapping(organization, deviceType, measurement, direction); mapping != nil {
+			kafkaMessage = parseJsonMapping(mapping, organization, measurement, deviceType, deviceId, direction, etc, incoming[1])
+		} else {
+			switch organization {
+			case "IMT":
+				switch deviceType {
+				case "LNS":
+					kafkaMessage = parseLns(measurement, deviceId, direction, etc, incoming[1])
 
-			case "EVSE":
-				kafkaMessage = parseEvse(measurement, deviceType, deviceId, direction, etc, incoming[1])
+				case "EVSE":
+					kafkaMessage = parseEvse(organization, measurement, deviceType, deviceId, direction, etc, incoming[1])
 
-			case "NSPI":
-				kafkaMessage = parseNspi(measurement, deviceType, deviceId, direction, etc, incoming[1])
+				case "NSPI":
+					kafkaMessage = parseNspi(measurement, deviceType, deviceId, direction, etc, incoming[1])
 
-			case "HealthPack":
-				kafkaMessage = parseHealthPack(measurement, deviceType, deviceId, direction, etc, incoming[1])
+				case "HealthPack":
+					kafkaMessage = parseHealthPack(organization, measurement, deviceType, deviceId, direction, etc, incoming[1])
 
-			default:
-			}
-		case "SaoRafael":
-			switch deviceType {
-			case "HealthPack":
-				kafkaMessage = parseHealthPack(measurement, deviceType, deviceId, direction, etc, incoming[1])
+				default:
+				}
+			case "SaoRafael":
+				switch deviceType {
+				case "HealthPack":
+					kafkaMessage = parseHealthPack(organization, measurement, deviceType, deviceId, direction, etc, incoming[1])
+				}
 			}
 		}
 
+		// Gateway side processing of the decoded values
+		if direction == "up" && kafkaMessage != "" {
+			now := time.Now()
+			markSeen(deviceType, measurement, deviceId, now)
+			kafkaMessage = estimateBattery(kafkaMessage, deviceType, deviceId, now)
+			evaluateAlertRules(kafkaMessage, deviceType, deviceId, now)
+		}
+
+		// Personal data is protected before it is logged or produced
+		kafkaMessage = applyPrivacy(kafkaMessage)
+
 		fmt.Printf("\n>>>>")
 		fmt.Printf("\nTopic: %s", incoming[0])
 		fmt.Printf("\nMessage: %s", kafkaMessage)
 		fmt.Printf("\n>>>>")
 
-		// SET KAFKA
-		// KafkaProducerClient
-		var sbKafkaProdTopic strings.Builder
-		// TODO : parse by ORGANIZATION
-		// sbKafkaProdTopic.WriteString(organization)
-		sbKafkaProdTopic.WriteString("IMT")
-		sbKafkaProdTopic.WriteString(".")
-		sbKafkaProdTopic.WriteString(BUCKET)
-		kafkaProdTopic := sbKafkaProdTopic.String()
 		// pClient.Publish(sbPubTopic.String(), byte(pQos), false, incoming[1])
-
-		kafkaProdClient.Produce(&kafka.Message{
-			TopicPartition: kafka.TopicPartition{Topic: &kafkaProdTopic, Partition: kafka.PartitionAny},
-			Value:          []byte(kafkaMessage),
-			Headers:        []kafka.Header{{Key: "myTestHeader", Value: []byte("header values are binary")}},
-		}, nil)
-		if err != nil {
-			fmt.Printf("Produce failed: %v\n", err)
-			os.Exit(1)
+		switch {
+		case kafkaMessage == "":
+			msg.Ack()
+		case deviceType == "EVSE" && direction == "down":
+			// A command is acknowledged once forwarded, a redelivery would send it to the charger again
+			msg.Ack()
+			produce(kafkaProdTopic, kafkaMessage, nil)
+		default:
+			produce(kafkaProdTopic, kafkaMessage, msg)
 		}
 
+		flushRecords()
+
 		kafkaProdClient.Flush(15 * 1000)
 	}
 }
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JsonMapping decodes the JSON uplinks of a device family from configuration alone, e.g.
+//
+//	{"device_type": "AirQuality", "device_id": "$.id", "tags": {"room": "$.location.room"},
+//	 "fields": {"co2": "$.sensors.co2", "alarm": {"path": "$.alarm", "type": "bool"}},
+//	 "timestamp": "$.ts", "timestamp_format": "unix_ms", "sample": {...}}
+type JsonMapping struct {
+	Organization string `json:"organization"` // topic organization, every one when empty
+	DeviceType   string `json:"device_type"`  // topic deviceType
+	Measurement  string `json:"measurement"`  // topic measurement, every one when empty
+	Direction    string `json:"direction"`    // topic direction, up when empty
+
+	Name     string                      `json:"name"`      // measurement written, a path or a literal; the topic measurement when empty
+	DeviceId string                      `json:"device_id"` // path of the deviceId, the topic deviceId when empty
+	Tags     map[string]string           `json:"tags"`      // tag key to path
+	Fields   map[string]JsonMappingField `json:"fields"`    // field key to path
+
+	Timestamp       string `json:"timestamp"`        // path of the timestamp, the receive time when empty
+	TimestampFormat string `json:"timestamp_format"` // unix, unix_ms, unix_us, unix_ns (default), rfc3339 or a Go layout
+
+	Sample json.RawMessage `json:"sample"` // payload that must decode every field, checked at startup
+}
+
+// JsonMappingField is a path, or an object with the path and the type of the field.
+type JsonMappingField struct {
+	Path string `json:"path"`
+	Type string `json:"type"` // float, int, bool or string; taken from the JSON value when empty
+}
+
+func (f *JsonMappingField) UnmarshalJSON(b []byte) error {
+	var path string
+	if err := json.Unmarshal(b, &path); err == nil {
+		f.Path = path
+		return nil
+	}
+	type jsonMappingField JsonMappingField
+	return json.Unmarshal(b, (*jsonMappingField)(f))
+}
+
+var measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+
+// findJsonMapping returns the mapping of a topic, or nil.
+func findJsonMapping(organization string, deviceType string, measurement string, direction string) *JsonMapping {
+	for i := range schema.JsonMappings {
+		mapping := &schema.JsonMappings[i]
+		if (mapping.Organization == "" || mapping.Organization == organization) &&
+			mapping.DeviceType == deviceType &&
+			(mapping.Measurement == "" || mapping.Measurement == measurement) &&
+			(mapping.Direction == direction || (mapping.Direction == "" && direction == "up")) {
+			return mapping
+		}
+	}
+	return nil
+}
+
+// parseJsonMapping writes a message as
+// {name},deviceId=,deviceType=,direction=,origin=,{tags} {fields} timestamp
+// Tags and fields missing from the message are left out, and "" is returned when no field is left.
+func parseJsonMapping(mapping *JsonMapping, organization string, measurement string, deviceType string, deviceId string, direction string, etc string, message string) string {
+	var sb strings.Builder
+
+	var data any
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		fmt.Printf("\n%s %s is not JSON: %v", deviceType, measurement, err)
+		return ""
+	}
+
+	fields := jsonMappingFields(mapping, data)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	name := measurement
+	if mapping.Name != "" {
+		name = mapping.Name
+		if strings.HasPrefix(name, "$") {
+			if value := jsonPathString(data, name); value != "" {
+				name = value
+			} else {
+				name = measurement
+			}
+		}
+	}
+	if mapping.DeviceId != "" {
+		if id := jsonPathString(data, mapping.DeviceId); id != "" {
+			deviceId = id
+		}
+	}
+	timestamp := time.Now().UnixNano()
+	if mapping.Timestamp != "" {
+		location := deviceLocation(organization, "UTC", deviceId, deviceType)
+		value := jsonPath(data, mapping.Timestamp)
+		if t, ok := jsonMappingTime(value, mapping.TimestampFormat, location); ok {
+			timestamp = t.UnixNano()
+		} else {
+			fmt.Printf("\nInvalid timestamp %v at %s of %s %s, using the receive time", value, mapping.Timestamp, deviceType, deviceId)
+			jsonMappingTimeInvalid.Add(1)
+		}
+	}
+
+	// Measurement
+	sb.WriteString(measurementEscaper.Replace(name))
+
+	// Tags
+	writeTag(&sb, "deviceId", deviceId)
+	writeTag(&sb, "deviceType", deviceType)
+	writeTag(&sb, "direction", direction)
+	writeTag(&sb, "origin", etc)
+	for _, key := range sortedKeys(mapping.Tags) {
+		writeTag(&sb, fieldKeyEscaper.Replace(key), jsonPathString(data, mapping.Tags[key]))
+	}
+
+	// Fields
+	for i, key := range sortedKeys(fields) {
+		if i == 0 {
+			sb.WriteString(` `)
+		} else {
+			sb.WriteString(`,`)
+		}
+		sb.WriteString(fieldKeyEscaper.Replace(key))
+		sb.WriteString(`=`)
+		sb.WriteString(fields[key])
+	}
+
+	// Timestamp_ns
+	sb.WriteString(` `)
+	sb.WriteString(strconv.FormatInt(timestamp, 10))
+
+	return sb.String()
+}
+
+// jsonMappingFields returns the line protocol values of the mapped fields found in data.
+func jsonMappingFields(mapping *JsonMapping, data any) map[string]string {
+	fields := make(map[string]string)
+	for key, field := range mapping.Fields {
+		if value, ok := jsonMappingValue(jsonPath(data, field.Path), field.Type); ok {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// jsonMappingValue formats value as a field of type. Numbers sent as strings and 0/1 flags are
+// accepted, objects and arrays are only kept, as JSON, by string fields.
+func jsonMappingValue(value any, fieldType string) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case json.Number:
+		if fieldType == "" {
+			fieldType = "float"
+		}
+		return healthPackValue(v.String(), fieldType)
+	case bool:
+		if fieldType == "" || fieldType == "bool" {
+			return strconv.FormatBool(v), true
+		}
+		if fieldType == "string" {
+			return `"` + strconv.FormatBool(v) + `"`, true
+		}
+		return "", false
+	case string:
+		if fieldType == "" || fieldType == "string" {
+			return `"` + fieldStringEscaper.Replace(v) + `"`, true
+		}
+		return healthPackValue(strings.TrimSpace(v), fieldType)
+	default:
+		if fieldType != "string" {
+			return "", false
+		}
+		b, _ := json.Marshal(v)
+		return `"` + fieldStringEscaper.Replace(string(b)) + `"`, true
+	}
+}
+
+// jsonMappingTime parses a timestamp in format. Layouts without a zone are read in location.
+func jsonMappingTime(value any, format string, location *time.Location) (time.Time, bool) {
+	var s string
+	switch v := value.(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		s = strings.TrimSpace(v)
+	default:
+		return time.Time{}, false
+	}
+
+	switch format {
+	case "", "unix", "unix_ms", "unix_us", "unix_ns":
+		unit := map[string]int64{"": 1, "unix": 1e9, "unix_ms": 1e6, "unix_us": 1e3, "unix_ns": 1}[format]
+		// Integers are kept exact, ns do not fit in a float64
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Unix(0, n*unit), true
+		}
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(0, int64(n*float64(unit))), true
+	case "rfc3339":
+		t, err := time.Parse(time.RFC3339, s)
+		return t, err == nil
+	default:
+		t, err := time.ParseInLocation(format, s, location)
+		return t, err == nil
+	}
+}
+
+// jsonPath returns the value at path in data, or nil. A path is "$" followed by ".key" and
+// "[index]" steps, e.g. "$.sensors[0].value"; the leading "$." may be left out.
+func jsonPath(data any, path string) any {
+	steps, err := parseJsonPath(path)
+	if err != nil {
+		return nil
+	}
+	for _, step := range steps {
+		switch v := data.(type) {
+		case map[string]any:
+			data = v[step]
+		case []any:
+			i, err := strconv.Atoi(step)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			data = v[i]
+		default:
+			return nil
+		}
+	}
+	return data
+}
+
+// jsonPathString returns the value at path as text, "" when missing or not a scalar.
+func jsonPathString(data any, path string) string {
+	switch v := jsonPath(data, path).(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+func parseJsonPath(path string) ([]string, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return nil, nil
+	}
+	var steps []string
+	for _, part := range strings.Split(path, ".") {
+		key, rest, _ := strings.Cut(part, "[")
+		if key != "" {
+			steps = append(steps, key)
+		} else if rest == "" {
+			return nil, fmt.Errorf("empty step in path %q", path)
+		}
+		for rest != "" {
+			index, after, ok := strings.Cut(rest, "]")
+			if _, err := strconv.Atoi(index); !ok || err != nil {
+				return nil, fmt.Errorf("invalid index in path %q", path)
+			}
+			steps = append(steps, index)
+			rest = strings.TrimPrefix(after, "[")
+			if after != "" && !strings.HasPrefix(after, "[") {
+				return nil, fmt.Errorf("invalid index in path %q", path)
+			}
+		}
+	}
+	return steps, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func validateJsonMappings(mappings []JsonMapping) error {
+	for _, mapping := range mappings {
+		if mapping.DeviceType == "" {
+			return fmt.Errorf("json mapping needs a device_type")
+		}
+		if len(mapping.Fields) == 0 {
+			return fmt.Errorf("json mapping of %s needs fields", mapping.DeviceType)
+		}
+		paths := []string{mapping.DeviceId, mapping.Timestamp}
+		if strings.HasPrefix(mapping.Name, "$") {
+			paths = append(paths, mapping.Name)
+		}
+		for _, path := range mapping.Tags {
+			paths = append(paths, path)
+		}
+		for key, field := range mapping.Fields {
+			switch field.Type {
+			case "", "float", "int", "bool", "string":
+			default:
+				return fmt.Errorf("json mapping of %s field %s has unknown type %q", mapping.DeviceType, key, field.Type)
+			}
+			if field.Path == "" {
+				return fmt.Errorf("json mapping of %s field %s needs a path", mapping.DeviceType, key)
+			}
+			paths = append(paths, field.Path)
+		}
+		for _, path := range paths {
+			if _, err := parseJsonPath(path); err != nil {
+				return fmt.Errorf("json mapping of %s: %w", mapping.DeviceType, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkJsonMappingSamples decodes the sample of every mapping, which must give each field and
+// tag, and its timestamp in the configured format. Untyped fields take the type of their sample.
+func checkJsonMappingSamples() error {
+	for i := range schema.JsonMappings {
+		mapping := &schema.JsonMappings[i]
+		if len(mapping.Sample) == 0 {
+			continue
+		}
+
+		var data any
+		decoder := json.NewDecoder(bytes.NewReader(mapping.Sample))
+		decoder.UseNumber()
+		if err := decoder.Decode(&data); err != nil {
+			return fmt.Errorf("json mapping of %s: sample: %w", mapping.DeviceType, err)
+		}
+
+		fields := jsonMappingFields(mapping, data)
+		for _, key := range sortedKeys(mapping.Fields) {
+			if _, ok := fields[key]; !ok {
+				return fmt.Errorf("json mapping of %s: sample has no valid field %s at %s", mapping.DeviceType, key, mapping.Fields[key].Path)
+			}
+
+			// Untyped fields keep the type of the sample, so a message cannot change it
+			if field := mapping.Fields[key]; field.Type == "" {
+				switch jsonPath(data, field.Path).(type) {
+				case json.Number:
+					field.Type = "float"
+				case bool:
+					field.Type = "bool"
+				default:
+					field.Type = "string"
+				}
+				mapping.Fields[key] = field
+			}
+		}
+		for _, key := range sortedKeys(mapping.Tags) {
+			if jsonPathString(data, mapping.Tags[key]) == "" {
+				return fmt.Errorf("json mapping of %s: sample has no tag %s at %s", mapping.DeviceType, key, mapping.Tags[key])
+			}
+		}
+		if mapping.Timestamp != "" {
+			if _, ok := jsonMappingTime(jsonPath(data, mapping.Timestamp), mapping.TimestampFormat, time.UTC); !ok {
+				return fmt.Errorf("json mapping of %s: sample has no valid timestamp at %s", mapping.DeviceType, mapping.Timestamp)
+			}
+		}
+	}
+	return nil
+}
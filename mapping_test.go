@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestJsonMappingFixtures decodes the payloads of testdata/mappings/{device_type} with the mappings
+// of schema.json and compares the records with the .line file next to them, empty when the
+// payload produces no record.
+func TestJsonMappingFixtures(t *testing.T) {
+	saved := schema
+	t.Cleanup(func() { schema = saved })
+
+	var err error
+	if schema, err = loadSchema("schema.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkJsonMappingSamples(); err != nil {
+		t.Fatal(err)
+	}
+
+	payloads, err := filepath.Glob("testdata/mappings/*/*.json")
+	if err != nil || len(payloads) == 0 {
+		t.Fatalf("no fixtures: %v", err)
+	}
+	for _, payload := range payloads {
+		deviceType := filepath.Base(filepath.Dir(payload))
+		t.Run(deviceType+"/"+strings.TrimSuffix(filepath.Base(payload), ".json"), func(t *testing.T) {
+			message, err := os.ReadFile(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := os.ReadFile(strings.TrimSuffix(payload, ".json") + ".line")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mapping := findJsonMapping("IMT", deviceType, "Uplink", "up")
+			if mapping == nil {
+				t.Fatalf("no mapping of %s in schema.json", deviceType)
+			}
+			got := parseJsonMapping(mapping, "IMT", "Uplink", deviceType, "topic-id", "up", "imt", string(message))
+			if got != strings.TrimSpace(string(want)) {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestJsonMappingInvalidTimestamp(t *testing.T) {
+	mapping := &JsonMapping{
+		DeviceType:      "AirQuality",
+		Fields:          map[string]JsonMappingField{"co2": {Path: "$.co2", Type: "float"}},
+		Timestamp:       "$.ts",
+		TimestampFormat: "rfc3339",
+	}
+	invalid := jsonMappingTimeInvalid.Value()
+
+	before := time.Now().UnixNano()
+	got := parseJsonMapping(mapping, "IMT", "Uplink", "AirQuality", "aq-0001", "up", "imt", `{"co2": 612, "ts": "yesterday"}`)
+	timestamp, ok := jsonMappingTime(json.Number(got[strings.LastIndex(got, " ")+1:]), "unix_ns", time.UTC)
+	if !ok || timestamp.UnixNano() < before {
+		t.Errorf("record not stamped with the receive time: %s", got)
+	}
+	if jsonMappingTimeInvalid.Value() != invalid+1 {
+		t.Errorf("invalid timestamp not counted")
+	}
+}
+
+func TestParseJsonPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		steps []string
+		valid bool
+	}{
+		{"$", nil, true},
+		{"", nil, true},
+		{"$.id", []string{"id"}, true},
+		{"id", []string{"id"}, true},
+		{"$.sensors.co2", []string{"sensors", "co2"}, true},
+		{"$.sensors[0].value", []string{"sensors", "0", "value"}, true},
+		{"$.matrix[1][2]", []string{"matrix", "1", "2"}, true},
+		{"$[0].id", []string{"0", "id"}, true},
+		{"$.sensors..co2", nil, false},
+		{"$.sensors[x]", nil, false},
+		{"$.sensors[0", nil, false},
+		{"$.sensors[0]x", nil, false},
+	}
+	for _, tt := range tests {
+		steps, err := parseJsonPath(tt.path)
+		if (err == nil) != tt.valid || (tt.valid && !reflect.DeepEqual(steps, tt.steps)) {
+			t.Errorf("%q: got %q, %v", tt.path, steps, err)
+		}
+	}
+}
+
+func TestJsonMappingValue(t *testing.T) {
+	tests := []struct {
+		value     any
+		fieldType string
+		want      string
+		ok        bool
+	}{
+		{json.Number("612"), "", "612", true},
+		{json.Number("23.4"), "float", "23.4", true},
+		{json.Number("87"), "int", "87i", true},
+		{json.Number("87.5"), "int", "", false},
+		{json.Number("1"), "bool", "true", true},
+		{"87", "int", "87i", true},
+		{" 23.4 ", "float", "23.4", true},
+		{"n/a", "float", "", false},
+		{"H204", "", `"H204"`, true},
+		{`say "hi"`, "string", `"say \"hi\""`, true},
+		{true, "", "true", true},
+		{true, "string", `"true"`, true},
+		{true, "int", "", false},
+		{nil, "float", "", false},
+		{map[string]any{"a": json.Number("1")}, "string", `"{\"a\":1}"`, true},
+		{[]any{json.Number("1")}, "float", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := jsonMappingValue(tt.value, tt.fieldType)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%v as %q: got %q, %v, want %q, %v", tt.value, tt.fieldType, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestJsonMappingTime(t *testing.T) {
+	saoPaulo, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2025, 10, 19, 11, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value  any
+		format string
+		want   time.Time
+		ok     bool
+	}{
+		{json.Number("1760871600"), "unix", want, true},
+		{json.Number("1760871600.5"), "unix", want.Add(500 * time.Millisecond), true},
+		{json.Number("1760871600000"), "unix_ms", want, true},
+		{"1760871600000", "unix_ms", want, true},
+		{json.Number("1760871600000000"), "unix_us", want, true},
+		{json.Number("1760871600000000123"), "", want.Add(123), true},
+		{json.Number("1760871600000000123"), "unix_ns", want.Add(123), true},
+		{"2025-10-19T08:00:00-03:00", "rfc3339", want, true},
+		{"2025-10-19 08:00:00", "2006-01-02 15:04:05", want, true},
+		{"yesterday", "rfc3339", time.Time{}, false},
+		{"soon", "unix", time.Time{}, false},
+		{true, "unix", time.Time{}, false},
+		{nil, "unix", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := jsonMappingTime(tt.value, tt.format, saoPaulo)
+		if ok != tt.ok || (ok && !got.Equal(tt.want)) {
+			t.Errorf("%v as %q: got %v, %v", tt.value, tt.format, got, ok)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+)
+
+// Gateway metrics, published as JSON on /debug/vars when METRICS_ADDR is set.
+var (
+	bufferDepth    = expvar.NewInt("bufferDepthRecords")
+	bufferBytes    = expvar.NewInt("bufferBytes")
+	bufferSegments = expvar.NewInt("bufferSegments")
+	bufferDropped  = expvar.NewInt("bufferDroppedRecords")
+
+	lnsDuplicatesDropped = expvar.NewInt("lnsDuplicatesDropped")
+	lnsOutOfOrder        = expvar.NewInt("lnsOutOfOrderUplinks")
+
+	nspiFieldCollisions = expvar.NewInt("nspiFieldCollisions")
+
+	healthPackClockInvalid = expvar.NewInt("healthPackClockInvalid")
+	jsonMappingTimeInvalid = expvar.NewInt("jsonMappingTimeInvalid")
+
+	privacyDropped = expvar.NewInt("privacyDroppedRecords")
+
+	evseCommandsFailed = expvar.NewInt("evseCommandsFailed")
+)
+
+func serveMetrics(addr string) {
+	fmt.Printf("Serving metrics on %s/debug/vars\n", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		fmt.Printf("Metrics server stopped: %v\n", err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// nspiMaxDepth is the nesting kept as fields, deeper values are written as JSON strings
+	nspiMaxDepth = 5
+	// nspiAllowFields and nspiDenyFields are patterns of flattened keys such as "sensor_*", deny wins
+	nspiAllowFields []string
+	nspiDenyFields  []string
+)
+
+// parseFieldPatterns splits a comma separated list of key patterns.
+func parseFieldPatterns(spec string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(spec, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// nspiGenericJsonFields flattens the data of a GenericJson message into fields: nested keys and
+// array indexes are joined with "_", numbers are floats, booleans bools and strings quoted. data
+// may be a JSON object or a string holding one, and the message itself is flattened without its
+// envelope keys when it has no data. It returns "" when no field is left.
+func nspiGenericJsonFields(message string) string {
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(message), &envelope); err != nil {
+		return ""
+	}
+
+	raw, ok := envelope["data"]
+	if !ok {
+		for _, key := range []string{"measurement", "deviceId", "deviceType", "timestamp"} {
+			delete(envelope, key)
+		}
+		raw, _ = json.Marshal(envelope)
+	}
+
+	var data any
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return ""
+	}
+	// Some devices send the JSON as a string
+	if s, ok := data.(string); ok {
+		decoder := json.NewDecoder(strings.NewReader(s))
+		decoder.UseNumber()
+		var inner any
+		if err := decoder.Decode(&inner); err == nil {
+			data = inner
+		}
+	}
+	if _, ok := data.(map[string]any); !ok {
+		data = map[string]any{"data": data}
+	}
+
+	fields := make(map[string]string)
+	flattenJson("", data, 0, fields, make(map[string]int))
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		if nspiFieldAllowed(key) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for i, key := range keys {
+		if i == 0 {
+			sb.WriteString(` `)
+		} else {
+			sb.WriteString(`,`)
+		}
+		sb.WriteString(fieldKeyEscaper.Replace(key))
+		sb.WriteString(`=`)
+		sb.WriteString(fields[key])
+	}
+	return sb.String()
+}
+
+// flattenJson adds the line protocol values of value to fields under key. Values nested deeper
+// than nspiMaxDepth are written as compact JSON strings and nulls are left out. Keys are visited
+// in order, and when two values flatten to the same key, e.g. {"gps_lat": 1, "gps": {"lat": 2}},
+// the least nested one is kept, or the first one at the same depth.
+func flattenJson(key string, value any, depth int, fields map[string]string, depths map[string]int) {
+	switch v := value.(type) {
+	case map[string]any:
+		if depth >= nspiMaxDepth && key != "" {
+			setFlatField(key, jsonStringField(v), depth, fields, depths)
+			return
+		}
+		for _, k := range sortedKeys(v) {
+			flattenJson(joinKey(key, k), v[k], depth+1, fields, depths)
+		}
+	case []any:
+		if depth >= nspiMaxDepth {
+			setFlatField(key, jsonStringField(v), depth, fields, depths)
+			return
+		}
+		for i, nested := range v {
+			flattenJson(joinKey(key, strconv.Itoa(i)), nested, depth+1, fields, depths)
+		}
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			setFlatField(key, strconv.FormatFloat(f, 'f', -1, 64), depth, fields, depths)
+		}
+	case bool:
+		setFlatField(key, strconv.FormatBool(v), depth, fields, depths)
+	case string:
+		setFlatField(key, `"`+fieldStringEscaper.Replace(v)+`"`, depth, fields, depths)
+	}
+}
+
+// setFlatField sets a flattened field unless a less or equally nested value already has its key.
+func setFlatField(key string, value string, depth int, fields map[string]string, depths map[string]int) {
+	if kept, ok := depths[key]; ok {
+		nspiFieldCollisions.Add(1)
+		fmt.Printf("\nNSPI field %s is set twice, the one at depth %d is kept", key, min(kept, depth))
+		if kept <= depth {
+			return
+		}
+	}
+	fields[key] = value
+	depths[key] = depth
+}
+
+func joinKey(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "_" + key
+}
+
+func jsonStringField(value any) string {
+	b, _ := json.Marshal(value)
+	return `"` + fieldStringEscaper.Replace(string(b)) + `"`
+}
+
+// nspiFieldAllowed reports whether a flattened key passes NSPI_ALLOW_FIELDS and NSPI_DENY_FIELDS.
+func nspiFieldAllowed(key string) bool {
+	for _, pattern := range nspiDenyFields {
+		if ok, _ := path.Match(pattern, key); ok {
+			return false
+		}
+	}
+	if len(nspiAllowFields) == 0 {
+		return true
+	}
+	for _, pattern := range nspiAllowFields {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import "testing"
+
+func TestNspiGenericJsonFields(t *testing.T) {
+	t.Cleanup(func() {
+		nspiMaxDepth = 5
+		nspiAllowFields, nspiDenyFields = nil, nil
+	})
+
+	tests := []struct {
+		name     string
+		maxDepth int
+		allow    string
+		deny     string
+		message  string
+		want     string
+	}{
+		{
+			name:    "nested object",
+			message: `{"data": {"temp": 21.5, "gps": {"lat": -23.6, "lon": -46.5}, "ok": true, "tag": "a \"b\"", "none": null}}`,
+			want:    ` gps_lat=-23.6,gps_lon=-46.5,ok=true,tag="a \"b\"",temp=21.5`,
+		},
+		{
+			name:    "data as a JSON string",
+			message: `{"data": "{\"temp\": 21.5, \"levels\": [1, 2]}"}`,
+			want:    ` levels_0=1,levels_1=2,temp=21.5`,
+		},
+		{
+			name:    "data as a plain string",
+			message: `{"data": "hello"}`,
+			want:    ` data="hello"`,
+		},
+		{
+			name:    "without data",
+			message: `{"measurement": "GenericJson", "deviceId": "n1", "timestamp": 1, "temp": 21.5}`,
+			want:    ` temp=21.5`,
+		},
+		{
+			name:     "depth limit",
+			maxDepth: 2,
+			message:  `{"data": {"a": {"b": {"c": 1}, "d": 2}, "e": [[1, 2]]}}`,
+			want:     ` a_b="{\"c\":1}",a_d=2,e_0="[1,2]"`,
+		},
+		{
+			name:    "allow patterns",
+			allow:   "temp*,gps_*",
+			message: `{"data": {"temp": 21.5, "temperature": 22, "gps": {"lat": -23.6}, "ok": true}}`,
+			want:    ` gps_lat=-23.6,temp=21.5,temperature=22`,
+		},
+		{
+			name:    "deny wins over allow",
+			allow:   "gps_*",
+			deny:    "gps_lon",
+			message: `{"data": {"gps": {"lat": -23.6, "lon": -46.5}}}`,
+			want:    ` gps_lat=-23.6`,
+		},
+		{
+			name:    "nothing allowed",
+			deny:    "*",
+			message: `{"data": {"temp": 21.5}}`,
+			want:    ``,
+		},
+		{
+			name:    "collision keeps the least nested value",
+			message: `{"data": {"gps_lat": 1, "gps": {"lat": 2}, "a": {"b_c": 3}, "a_b": {"c": 4}}}`,
+			want:    ` a_b_c=3,gps_lat=1`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nspiMaxDepth = 5
+			if tt.maxDepth > 0 {
+				nspiMaxDepth = tt.maxDepth
+			}
+			nspiAllowFields, nspiDenyFields = parseFieldPatterns(tt.allow), parseFieldPatterns(tt.deny)
+
+			// Collisions must not depend on the map order
+			for i := 0; i < 20; i++ {
+				if got := nspiGenericJsonFields(tt.message); got != tt.want {
+					t.Fatalf("got %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseNspiMeasurement(t *testing.T) {
+	// The measurement of the topic is written, not the one of the message
+	got := parseNspi("GenericJson", "NSPI", "n1", "up", "imt", `{"measurement": "Other", "deviceId": "n1", "timestamp": 5, "data": {"temp": 21.5}}`)
+	want := "GenericJson,deviceId=n1,deviceType=NSPI,direction=up,origin=imt temp=21.5 5"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := parseNspi("GenericJson", "NSPI", "n1", "up", "imt", `{"deviceId": "n1", "timestamp": 5, "data": {}}`); got != "" {
+		t.Errorf("record without fields: %q", got)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type EvseBootNotification struct {
+	ChargePointVendor       string `json:"chargePointVendor"`
+	ChargePointModel        string `json:"chargePointModel"`
+	ChargePointSerialNumber string `json:"chargePointSerialNumber"`
+	ChargeBoxSerialNumber   string `json:"chargeBoxSerialNumber"`
+	FirmwareVersion         string `json:"firmwareVersion"`
+	Iccid                   string `json:"iccid"`
+	Imsi                    string `json:"imsi"`
+	MeterType               string `json:"meterType"`
+	MeterSerialNumber       string `json:"meterSerialNumber"`
+	Status                  string `json:"status"`   // of the central system response, when forwarded
+	Interval                int64  `json:"interval"` // heartbeat interval in seconds, when forwarded
+}
+
+type EvseHeartbeat struct {
+	CurrentTime string `json:"currentTime"`
+}
+
+type EvseAuthorize struct {
+	IdTag     string        `json:"idTag"`
+	IdTagInfo EvseIdTagInfo `json:"idTagInfo"`
+}
+
+type EvseIdTagInfo struct {
+	Status     string `json:"status"` // Accepted, Blocked, Expired, Invalid or ConcurrentTx
+	ExpiryDate string `json:"expiryDate"`
+}
+
+type EvseDataTransfer struct {
+	VendorId  string `json:"vendorId"`
+	MessageId string `json:"messageId"`
+	Data      string `json:"data"`
+	Status    string `json:"status"`
+}
+
+// EvseFirmwareStatus is the payload of DiagnosticsStatusNotification and FirmwareStatusNotification.
+type EvseFirmwareStatus struct {
+	Status string `json:"status"`
+}
+
+type EvseMeterValueSample struct {
+	Timestamp    string             `json:"timestamp"` // RFC 3339
+	SampledValue []EvseSampledValue `json:"sampledValue"`
+}
+
+type EvseSampledValue struct {
+	Value     string `json:"value"`
+	Context   string `json:"context"`
+	Format    string `json:"format"`
+	Measurand string `json:"measurand"`
+	Phase     string `json:"phase"`
+	Location  string `json:"location"`
+	Unit      string `json:"unit"`
+}
+
+// parseOcppMeasurement writes the tags and fields of the OCPP 1.6 messages that only report a
+// state of the charger. It returns "" for other measurements.
+func parseOcppMeasurement(measurement string, data string) string {
+	var sb strings.Builder
+
+	switch measurement {
+	case "BootNotification":
+		var evseBootNotification EvseBootNotification
+		json.Unmarshal([]byte(data), &evseBootNotification)
+
+		writeTag(&sb, "chargePointVendor", evseBootNotification.ChargePointVendor)
+		writeTag(&sb, "chargePointModel", evseBootNotification.ChargePointModel)
+		sb.WriteString(` `)
+		sb.WriteString(`firmwareVersion="`)
+		sb.WriteString(fieldStringEscaper.Replace(evseBootNotification.FirmwareVersion))
+		sb.WriteString(`"`)
+		writeStringField(&sb, "chargePointSerialNumber", evseBootNotification.ChargePointSerialNumber)
+		writeStringField(&sb, "chargeBoxSerialNumber", evseBootNotification.ChargeBoxSerialNumber)
+		writeStringField(&sb, "iccid", evseBootNotification.Iccid)
+		writeStringField(&sb, "imsi", evseBootNotification.Imsi)
+		writeStringField(&sb, "meterType", evseBootNotification.MeterType)
+		writeStringField(&sb, "meterSerialNumber", evseBootNotification.MeterSerialNumber)
+		writeStringField(&sb, "status", evseBootNotification.Status)
+		if evseBootNotification.Interval > 0 {
+			sb.WriteString(`,interval=`)
+			sb.WriteString(strconv.FormatInt(evseBootNotification.Interval, 10))
+		}
+
+	case "Heartbeat":
+		var evseHeartbeat EvseHeartbeat
+		json.Unmarshal([]byte(data), &evseHeartbeat)
+
+		sb.WriteString(` `)
+		sb.WriteString(`heartbeat=true`)
+		writeStringField(&sb, "currentTime", evseHeartbeat.CurrentTime)
+
+	case "Authorize":
+		var evseAuthorize EvseAuthorize
+		json.Unmarshal([]byte(data), &evseAuthorize)
+
+		writeTag(&sb, "authorizationStatus", evseAuthorize.IdTagInfo.Status)
+		sb.WriteString(` `)
+		sb.WriteString(`idTag="`)
+		sb.WriteString(fieldStringEscaper.Replace(evseAuthorize.IdTag))
+		sb.WriteString(`"`)
+		writeStringField(&sb, "expiryDate", evseAuthorize.IdTagInfo.ExpiryDate)
+
+	case "DataTransfer":
+		var evseDataTransfer EvseDataTransfer
+		json.Unmarshal([]byte(data), &evseDataTransfer)
+
+		writeTag(&sb, "vendorId", evseDataTransfer.VendorId)
+		writeTag(&sb, "messageId", evseDataTransfer.MessageId)
+		sb.WriteString(` `)
+		sb.WriteString(`data="`)
+		sb.WriteString(fieldStringEscaper.Replace(evseDataTransfer.Data))
+		sb.WriteString(`"`)
+		writeStringField(&sb, "status", evseDataTransfer.Status)
+
+	case "DiagnosticsStatusNotification", "FirmwareStatusNotification":
+		var evseFirmwareStatus EvseFirmwareStatus
+		json.Unmarshal([]byte(data), &evseFirmwareStatus)
+
+		sb.WriteString(` `)
+		sb.WriteString(`status="`)
+		sb.WriteString(fieldStringEscaper.Replace(evseFirmwareStatus.Status))
+		sb.WriteString(`"`)
+	}
+
+	return sb.String()
+}
+
+// OcppId is a transaction id, an integer in OCPP 1.6 and a string in OCPP 2.0.1.
+type OcppId string
+
+func (id *OcppId) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*id = OcppId(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*id = OcppId(n)
+	return nil
+}
+
+func (id OcppId) String() string {
+	return string(id)
+}
+
+// writeTransactionId writes the integer ids of OCPP 1.6 as transactionId and the string ids of
+// OCPP 2.0.1 as transactionRef, so the transactionId field keeps its type.
+func writeTransactionId(sb *strings.Builder, id OcppId) {
+	if _, err := strconv.ParseInt(id.String(), 10, 64); err == nil || id == "" {
+		sb.WriteString(`transactionId=`)
+		sb.WriteString(id.String())
+		return
+	}
+	sb.WriteString(`transactionRef="`)
+	sb.WriteString(fieldStringEscaper.Replace(id.String()))
+	sb.WriteString(`"`)
+}
+
+// writeTag writes ",key=value" unless value is empty.
+func writeTag(sb *strings.Builder, key string, value string) {
+	if value == "" {
+		return
+	}
+	sb.WriteString(`,`)
+	sb.WriteString(key)
+	sb.WriteString(`=`)
+	sb.WriteString(tagValueEscaper.Replace(value))
+}
+
+// writeStringField writes `,key="value"` unless value is empty.
+func writeStringField(sb *strings.Builder, key string, value string) {
+	if value == "" {
+		return
+	}
+	sb.WriteString(`,`)
+	sb.WriteString(key)
+	sb.WriteString(`="`)
+	sb.WriteString(fieldStringEscaper.Replace(value))
+	sb.WriteString(`"`)
+}
+
+// emitSampledValues emits a MeterValues record for every numeric sampledValue of a MeterValues
+// message, tagged with its measurand, phase, unit, context and location. Missing ones are taken
+// from the message, else the OCPP defaults, so that series of a quantity always share their tags.
+func emitSampledValues(evseUp EvseUp, samples []EvseMeterValueSample, transactionId string, deviceType string, etc string) {
+	for _, sample := range samples {
+		timestamp := evseUp.Timestamp
+		if t, err := time.Parse(time.RFC3339, sample.Timestamp); err == nil {
+			timestamp = t.UnixNano()
+		}
+
+		for _, sampledValue := range sample.SampledValue {
+			if sampledValue.Format == "SignedData" {
+				continue
+			}
+			value, err := strconv.ParseFloat(strings.TrimSpace(sampledValue.Value), 64)
+			if err != nil {
+				continue
+			}
+
+			var sb strings.Builder
+
+			sb.WriteString(`MeterValues`)
+
+			// Tags
+			writeTag(&sb, "deviceId", evseUp.DeviceId)
+			writeTag(&sb, "deviceType", deviceType)
+			writeTag(&sb, "connectorId", evseUp.ConnectorId)
+			writeTag(&sb, "chargePointId", evseUp.ChargePointId)
+			sb.WriteString(`,direction=up`)
+			writeTag(&sb, "origin", etc)
+			writeTag(&sb, "measurand", ocppDefault(sampledValue.Measurand, evseUp.Measurand, "Energy.Active.Import.Register"))
+			writeTag(&sb, "phase", sampledValue.Phase)
+			writeTag(&sb, "unit", ocppDefault(sampledValue.Unit, evseUp.Unit, "Wh"))
+			writeTag(&sb, "context", ocppDefault(sampledValue.Context, evseUp.Context, "Sample.Periodic"))
+			writeTag(&sb, "location", ocppDefault(sampledValue.Location, evseUp.Location, "Outlet"))
+
+			// Fields
+			sb.WriteString(` `)
+			sb.WriteString(`value=`)
+			sb.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+			writeStringField(&sb, "transactionId", transactionId)
+
+			// Timestamp_ns
+			sb.WriteString(` `)
+			sb.WriteString(strconv.FormatInt(timestamp, 10))
+
+			emitRecord(sb.String())
+		}
+	}
+}
+
+// ocppDefault returns the first non empty value.
+func ocppDefault(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
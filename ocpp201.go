@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Ocpp201TransactionEvent struct {
+	EventType       string                 `json:"eventType"` // Started, Updated or Ended
+	TriggerReason   string                 `json:"triggerReason"`
+	TransactionInfo Ocpp201TransactionInfo `json:"transactionInfo"`
+	IdToken         Ocpp201IdToken         `json:"idToken"`
+	Evse            Ocpp201Evse            `json:"evse"` // only required in the first event of a transaction
+	MeterValue      []Ocpp201MeterValue    `json:"meterValue"`
+}
+
+type Ocpp201TransactionInfo struct {
+	TransactionId string `json:"transactionId"`
+	ChargingState string `json:"chargingState"`
+	StoppedReason string `json:"stoppedReason"`
+}
+
+type Ocpp201IdToken struct {
+	IdToken string `json:"idToken"`
+	Type    string `json:"type"`
+}
+
+type Ocpp201Evse struct {
+	Id          json.Number `json:"id"`
+	ConnectorId json.Number `json:"connectorId"`
+}
+
+type Ocpp201MeterValue struct {
+	Timestamp    string                `json:"timestamp"`
+	SampledValue []Ocpp201SampledValue `json:"sampledValue"`
+}
+
+type Ocpp201SampledValue struct {
+	Value         float64 `json:"value"`
+	Context       string  `json:"context"`
+	Measurand     string  `json:"measurand"`
+	Phase         string  `json:"phase"`
+	Location      string  `json:"location"`
+	UnitOfMeasure struct {
+		Unit       string `json:"unit"`
+		Multiplier int    `json:"multiplier"`
+	} `json:"unitOfMeasure"`
+}
+
+type Ocpp201StatusNotification struct {
+	ConnectorStatus string      `json:"connectorStatus"`
+	EvseId          json.Number `json:"evseId"`
+	ConnectorId     json.Number `json:"connectorId"`
+}
+
+type Ocpp201MeterValues struct {
+	EvseId     json.Number         `json:"evseId"`
+	MeterValue []Ocpp201MeterValue `json:"meterValue"`
+}
+
+type Ocpp201BootNotification struct {
+	Reason          string `json:"reason"`
+	ChargingStation struct {
+		SerialNumber    string `json:"serialNumber"`
+		Model           string `json:"model"`
+		VendorName      string `json:"vendorName"`
+		FirmwareVersion string `json:"firmwareVersion"`
+		Modem           struct {
+			Iccid string `json:"iccid"`
+			Imsi  string `json:"imsi"`
+		} `json:"modem"`
+	} `json:"chargingStation"`
+}
+
+type Ocpp201Authorize struct {
+	IdToken     Ocpp201IdToken `json:"idToken"`
+	IdTokenInfo struct {
+		Status string `json:"status"`
+	} `json:"idTokenInfo"`
+}
+
+type Ocpp201NotifyReport struct {
+	RequestId  json.Number         `json:"requestId"`
+	ReportData []Ocpp201ReportData `json:"reportData"`
+}
+
+type Ocpp201ReportData struct {
+	Component struct {
+		Name     string      `json:"name"`
+		Instance string      `json:"instance"`
+		Evse     Ocpp201Evse `json:"evse"`
+	} `json:"component"`
+	Variable struct {
+		Name     string `json:"name"`
+		Instance string `json:"instance"`
+	} `json:"variable"`
+	VariableAttribute []struct {
+		Type  string `json:"type"` // Actual when empty
+		Value string `json:"value"`
+	} `json:"variableAttribute"`
+	VariableCharacteristics struct {
+		Unit     string `json:"unit"`
+		DataType string `json:"dataType"`
+	} `json:"variableCharacteristics"`
+}
+
+// ocppVersion returns the OCPP version of a charger: "2.0.1" when the topic etc segment names it
+// (ocpp201, ocpp2.0.1), else the ocpp_version of the device in the registry, else "1.6".
+func ocppVersion(deviceId string, etc string) string {
+	switch strings.ToLower(strings.ReplaceAll(etc, ".", "")) {
+	case "ocpp201", "ocpp2":
+		return "2.0.1"
+	case "ocpp16":
+		return "1.6"
+	}
+	if device := lookupDevice(deviceId, "EVSE"); device != nil && device.OcppVersion != "" {
+		return device.OcppVersion
+	}
+	return "1.6"
+}
+
+// normalizeOcpp201 rewrites an OCPP 2.0.1 message as the OCPP 1.6 message parseEvse decodes, so
+// that both versions produce the same measurements. The evseId of 2.0.1 takes the place of the
+// 1.6 connectorId. TransactionEvent becomes StartTransaction, MeterValues or StopTransaction by its
+// eventType. NotifyReport has no 1.6 counterpart and is emitted as NotifyReport records, returning
+// an empty message. Messages that are the same in both versions are returned unchanged.
+func normalizeOcpp201(measurement string, message string, deviceType string, etc string) (string, string) {
+	var envelope map[string]any
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.UseNumber()
+	if err := decoder.Decode(&envelope); err != nil {
+		return measurement, message
+	}
+
+	// The timestamp of a 2.0.1 message is RFC 3339, the one of the envelope is in ns
+	timestamp := time.Now().UnixNano()
+	switch value := envelope["timestamp"].(type) {
+	case json.Number:
+		if ns, err := value.Int64(); err == nil {
+			timestamp = ns
+		}
+	case string:
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			timestamp = t.UnixNano()
+		}
+	}
+	envelope["timestamp"] = timestamp
+
+	// Go matches JSON keys case insensitively, so the 2.0.1 connectorId would land in the 1.6 one
+	delete(envelope, "connectorId")
+
+	switch measurement {
+	case "TransactionEvent":
+		var event Ocpp201TransactionEvent
+		json.Unmarshal([]byte(message), &event)
+
+		// Later events of a transaction may leave out the evse of the first one
+		if event.Evse.Id != "" {
+			envelope["ConnectorId"] = event.Evse.Id.String()
+		} else if session := chargingSessionOf(fmt.Sprint(envelope["chargePointId"]), event.TransactionInfo.TransactionId); session != nil {
+			envelope["ConnectorId"] = session.ConnectorId
+		}
+		envelope["transactionId"] = event.TransactionInfo.TransactionId
+		envelope["idTag"] = event.IdToken.IdToken
+
+		energy, hasEnergy := ocpp201Energy(event.MeterValue)
+		switch event.EventType {
+		case "Started":
+			measurement = "StartTransaction"
+			// Without a meter value the session takes its first energy sample as start
+			if hasEnergy {
+				envelope["startMeter"] = int64(math.Round(energy))
+			}
+			envelope["startTime"] = timestamp / int64(time.Second)
+			delete(envelope, "meterValue")
+		case "Ended":
+			measurement = "StopTransaction"
+			if hasEnergy {
+				envelope["meterStop"] = int64(math.Round(energy))
+			}
+			envelope["stopTime"] = timestamp / int64(time.Second)
+			envelope["reason"] = event.TransactionInfo.StoppedReason
+			delete(envelope, "meterValue")
+		default:
+			// An Updated event without meter values only tells the transaction goes on
+			if len(event.MeterValue) == 0 {
+				return measurement, ""
+			}
+			measurement = "MeterValues"
+			envelope["meterValue"] = ocpp201Samples(event.MeterValue)
+		}
+
+	case "StatusNotification":
+		var statusNotification Ocpp201StatusNotification
+		json.Unmarshal([]byte(message), &statusNotification)
+
+		envelope["ConnectorId"] = statusNotification.EvseId.String()
+		envelope["status"] = statusNotification.ConnectorStatus
+
+	case "MeterValues":
+		var meterValues Ocpp201MeterValues
+		json.Unmarshal([]byte(message), &meterValues)
+
+		envelope["ConnectorId"] = meterValues.EvseId.String()
+		envelope["meterValue"] = ocpp201Samples(meterValues.MeterValue)
+
+	case "BootNotification":
+		var bootNotification Ocpp201BootNotification
+		json.Unmarshal([]byte(message), &bootNotification)
+
+		station := bootNotification.ChargingStation
+		envelope["chargePointVendor"] = station.VendorName
+		envelope["chargePointModel"] = station.Model
+		envelope["chargePointSerialNumber"] = station.SerialNumber
+		envelope["firmwareVersion"] = station.FirmwareVersion
+		envelope["iccid"] = station.Modem.Iccid
+		envelope["imsi"] = station.Modem.Imsi
+
+	case "Authorize":
+		var authorize Ocpp201Authorize
+		json.Unmarshal([]byte(message), &authorize)
+
+		envelope["idTag"] = authorize.IdToken.IdToken
+		envelope["idTagInfo"] = map[string]string{"status": authorize.IdTokenInfo.Status}
+
+	case "DataTransfer":
+		// data is any JSON in 2.0.1 and a string in 1.6
+		if data, ok := envelope["data"]; ok {
+			if _, ok := data.(string); !ok {
+				b, _ := json.Marshal(data)
+				envelope["data"] = string(b)
+			}
+		}
+
+	case "NotifyReport":
+		var notifyReport Ocpp201NotifyReport
+		json.Unmarshal([]byte(message), &notifyReport)
+
+		var evseUp EvseUp
+		json.Unmarshal([]byte(message), &evseUp)
+		for _, reportData := range notifyReport.ReportData {
+			emitNotifyReport(evseUp, reportData, deviceType, etc, timestamp)
+		}
+		return measurement, ""
+
+	default:
+		return measurement, message
+	}
+
+	b, err := json.Marshal(envelope)
+	if err != nil {
+		fmt.Printf("\nNormalizing OCPP 2.0.1 %s failed: %v", measurement, err)
+		return measurement, message
+	}
+	return measurement, string(b)
+}
+
+// ocpp201Samples converts 2.0.1 meter values to 1.6 ones, applying the unit multiplier.
+func ocpp201Samples(meterValues []Ocpp201MeterValue) []EvseMeterValueSample {
+	samples := make([]EvseMeterValueSample, 0, len(meterValues))
+	for _, meterValue := range meterValues {
+		sample := EvseMeterValueSample{Timestamp: meterValue.Timestamp}
+		for _, sampledValue := range meterValue.SampledValue {
+			value := sampledValue.Value * math.Pow10(sampledValue.UnitOfMeasure.Multiplier)
+			sample.SampledValue = append(sample.SampledValue, EvseSampledValue{
+				Value:     strconv.FormatFloat(value, 'f', -1, 64),
+				Context:   sampledValue.Context,
+				Measurand: sampledValue.Measurand,
+				Phase:     sampledValue.Phase,
+				Location:  sampledValue.Location,
+				Unit:      sampledValue.UnitOfMeasure.Unit,
+			})
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// ocpp201Energy returns the last Energy.Active.Import.Register of the meter values in Wh.
+func ocpp201Energy(meterValues []Ocpp201MeterValue) (float64, bool) {
+	energy, ok := 0.0, false
+	for _, meterValue := range meterValues {
+		for _, sampledValue := range meterValue.SampledValue {
+			if ocppDefault(sampledValue.Measurand, "Energy.Active.Import.Register") != "Energy.Active.Import.Register" || sampledValue.Phase != "" {
+				continue
+			}
+			energy = sampledValue.Value * math.Pow10(sampledValue.UnitOfMeasure.Multiplier)
+			if sampledValue.UnitOfMeasure.Unit == "kWh" {
+				energy *= 1000
+			}
+			ok = true
+		}
+	}
+	return energy, ok
+}
+
+// emitNotifyReport emits a record per attribute of a reported variable as
+// NotifyReport,deviceId=,deviceType=,chargePointId=,direction=up,origin=,component=,componentInstance=,evseId=,variable=,variableInstance=,attributeType=,unit= value= timestamp
+// value is a number for integer and decimal variables and a string otherwise.
+func emitNotifyReport(evseUp EvseUp, reportData Ocpp201ReportData, deviceType string, etc string, timestamp int64) {
+	for _, attribute := range reportData.VariableAttribute {
+		var sb strings.Builder
+
+		sb.WriteString(`NotifyReport`)
+
+		// Tags
+		writeTag(&sb, "deviceId", evseUp.DeviceId)
+		writeTag(&sb, "deviceType", deviceType)
+		writeTag(&sb, "chargePointId", evseUp.ChargePointId)
+		sb.WriteString(`,direction=up`)
+		writeTag(&sb, "origin", etc)
+		writeTag(&sb, "component", reportData.Component.Name)
+		writeTag(&sb, "componentInstance", reportData.Component.Instance)
+		writeTag(&sb, "evseId", reportData.Component.Evse.Id.String())
+		writeTag(&sb, "variable", reportData.Variable.Name)
+		writeTag(&sb, "variableInstance", reportData.Variable.Instance)
+		writeTag(&sb, "attributeType", ocppDefault(attribute.Type, "Actual"))
+		writeTag(&sb, "unit", reportData.VariableCharacteristics.Unit)
+
+		// Fields
+		sb.WriteString(` `)
+		value, err := strconv.ParseFloat(attribute.Value, 64)
+		switch dataType := reportData.VariableCharacteristics.DataType; {
+		case (dataType == "integer" || dataType == "decimal") && err == nil:
+			sb.WriteString(`value=`)
+			sb.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+		default:
+			sb.WriteString(`value="`)
+			sb.WriteString(fieldStringEscaper.Replace(attribute.Value))
+			sb.WriteString(`"`)
+		}
+
+		// Timestamp_ns
+		sb.WriteString(` `)
+		sb.WriteString(strconv.FormatInt(timestamp, 10))
+
+		emitRecord(sb.String())
+	}
+}
+
+func validateOcppVersions(s Schema) error {
+	for _, organization := range s.Organizations {
+		for _, application := range organization.Applications {
+			for _, device := range application.Devices {
+				switch device.OcppVersion {
+				case "", "1.6", "2.0.1":
+				default:
+					return fmt.Errorf("device %s has unknown ocpp_version %q", device.DeviceId, device.OcppVersion)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// PrivacyRule protects a tag or field of a measurement before the record leaves the gateway, e.g.
+// {"measurement": "Ischemia", "field": "nome", "action": "drop"}
+type PrivacyRule struct {
+	Measurement string `json:"measurement"` // "*" for every measurement
+	Field       string `json:"field"`       // tag or field key
+	Action      string `json:"action"`      // drop, hash or encrypt
+}
+
+// defaultPrivacyRules are used when the schema has no privacy_rules.
+var defaultPrivacyRules = []PrivacyRule{
+	{Measurement: "Ischemia", Field: "nome", Action: "drop"},
+	{Measurement: "Ischemia", Field: "IdOperador", Action: "drop"},
+	{Measurement: "Ischemia", Field: "niveldepermissao", Action: "drop"},
+	{Measurement: "Ischemia", Field: "numtransplante", Action: "hash"},
+	{Measurement: "TransportSummary", Field: "numtransplante", Action: "hash"},
+}
+
+// privacyRules is the policy in force, set up by setupPrivacy.
+var privacyRules []PrivacyRule
+
+var (
+	privacyHashKey []byte
+	privacyCipher  cipher.AEAD
+)
+
+var stringFieldUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`)
+
+// setupPrivacy sets up the policy of the schema, or the default one, with the keys read from
+// PRIVACY_HASH_KEY and PRIVACY_ENCRYPTION_KEY. Without the key of an action its rules drop the
+// value instead, so a listed value never leaves the gateway in clear text.
+func setupPrivacy(rules []PrivacyRule) error {
+	if len(rules) == 0 {
+		rules = defaultPrivacyRules
+	}
+
+	privacyHashKey = []byte(getSecret("PRIVACY_HASH_KEY", ""))
+
+	privacyCipher = nil
+	if encoded := getSecret("PRIVACY_ENCRYPTION_KEY", ""); encoded != "" {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("PRIVACY_ENCRYPTION_KEY must be base64: %w", err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("PRIVACY_ENCRYPTION_KEY: %w", err)
+		}
+		privacyCipher, err = cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+	}
+
+	privacyRules = make([]PrivacyRule, 0, len(rules))
+	for _, rule := range rules {
+		switch {
+		case rule.Action == "hash" && len(privacyHashKey) == 0:
+			fmt.Printf("Privacy: no PRIVACY_HASH_KEY, %s.%s is dropped instead of hashed\n", rule.Measurement, rule.Field)
+			rule.Action = "drop"
+		case rule.Action == "encrypt" && privacyCipher == nil:
+			fmt.Printf("Privacy: no PRIVACY_ENCRYPTION_KEY, %s.%s is dropped instead of encrypted\n", rule.Measurement, rule.Field)
+			rule.Action = "drop"
+		}
+		privacyRules = append(privacyRules, rule)
+		fmt.Printf("Privacy: %s.%s %s\n", rule.Measurement, rule.Field, rule.Action)
+	}
+	return nil
+}
+
+// applyPrivacy drops, hashes or encrypts the tags and fields of a record listed in the policy.
+// Hashed and encrypted fields become strings. A record left without fields is dropped, and so is
+// a record of a measurement with rules that does not parse, as its listed values could not be
+// found. Records of the other measurements are passed through as they are.
+func applyPrivacy(message string) string {
+	if len(privacyRules) == 0 || message == "" || !privacyCovers(lineMeasurement(message)) {
+		return message
+	}
+	line, ok := parseLine(message)
+	if !ok {
+		privacyDropped.Add(1)
+		fmt.Printf("\nPrivacy: dropped a record that does not parse")
+		return ""
+	}
+
+	changed := false
+	for _, rule := range privacyRules {
+		if rule.Measurement != "*" && rule.Measurement != line.Measurement {
+			continue
+		}
+
+		if value, ok := line.Tags[rule.Field]; ok {
+			switch rule.Action {
+			case "drop":
+				delete(line.Tags, rule.Field)
+			case "hash":
+				line.Tags[rule.Field] = privacyHash(fieldKeyUnescaper.Replace(value))
+			case "encrypt":
+				line.Tags[rule.Field] = privacyEncrypt(fieldKeyUnescaper.Replace(value))
+			}
+			changed = true
+		}
+
+		if value, ok := line.Fields[rule.Field]; ok {
+			if strings.HasPrefix(value, `"`) {
+				value = stringFieldUnescaper.Replace(strings.TrimSuffix(strings.TrimPrefix(value, `"`), `"`))
+			}
+			switch rule.Action {
+			case "drop":
+				delete(line.Fields, rule.Field)
+			case "hash":
+				line.Fields[rule.Field] = `"` + privacyHash(value) + `"`
+			case "encrypt":
+				line.Fields[rule.Field] = `"` + privacyEncrypt(value) + `"`
+			}
+			changed = true
+		}
+	}
+
+	if !changed {
+		return message
+	}
+	if len(line.Fields) == 0 {
+		return ""
+	}
+	return formatLine(line)
+}
+
+// privacyCovers reports whether a rule of the policy applies to measurement.
+func privacyCovers(measurement string) bool {
+	for _, rule := range privacyRules {
+		if rule.Measurement == "*" || rule.Measurement == measurement {
+			return true
+		}
+	}
+	return false
+}
+
+// privacyHash is the hex HMAC-SHA256 of value, stable so that records can still be joined on it.
+func privacyHash(value string) string {
+	mac := hmac.New(sha256.New, privacyHashKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// privacyLogId stands for an identifier covered by the privacy rules in the logs: a short hash
+// when PRIVACY_HASH_KEY is set, so that the lines of one transport can be followed, else a mark.
+func privacyLogId(value string) string {
+	if len(privacyHashKey) == 0 {
+		return "[redacted]"
+	}
+	return privacyHash(value)[:12]
+}
+
+// privacyEncrypt seals value with AES-GCM under a random nonce and returns nonce and ciphertext
+// in unpadded URL base64, which needs no escaping in line protocol.
+func privacyEncrypt(value string) string {
+	nonce := make([]byte, privacyCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(privacyCipher.Seal(nonce, nonce, []byte(value), nil))
+}
+
+func validatePrivacyRules(rules []PrivacyRule) error {
+	for _, rule := range rules {
+		if rule.Measurement == "" || rule.Field == "" {
+			return fmt.Errorf("privacy rule needs a measurement and field")
+		}
+		switch rule.Action {
+		case "drop", "hash", "encrypt":
+		default:
+			return fmt.Errorf("privacy rule %s.%s has unknown action %q", rule.Measurement, rule.Field, rule.Action)
+		}
+	}
+	return nil
+}
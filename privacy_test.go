@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+const (
+	ischemiaRecord  = `Ischemia,deviceId=HP\ 01,deviceType=HealthPack,orgao=rim,numtransplante=TX-2024-001 idModal="M1",nome="Maria Silva",IdOperador="op-77",niveldepermissao="3",tempo_restante_isquemia=3600 1700000000000000000`
+	transportRecord = `TransportSummary,deviceId=HP\ 01,deviceType=HealthPack,direction=event,origin=imt,orgao=rim,numtransplante=TX-2024-001 idModal="M1",durationSeconds=600 1700000000000000000`
+)
+
+var privacyClearText = []string{"Maria Silva", "op-77", "TX-2024-001"}
+
+func setupPrivacyTest(t *testing.T, rules []PrivacyRule, hashKey string, encryptionKey string) {
+	t.Helper()
+	t.Setenv("PRIVACY_HASH_KEY", hashKey)
+	t.Setenv("PRIVACY_ENCRYPTION_KEY", encryptionKey)
+	if err := setupPrivacy(rules); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { privacyRules = nil })
+}
+
+func TestApplyPrivacy(t *testing.T) {
+	encryptionKey := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+	tests := []struct {
+		name          string
+		rules         []PrivacyRule
+		hashKey       string
+		encryptionKey string
+		record        string
+		want          string // exact output, when not empty
+		hashed        []string
+		encrypted     []string
+		dropped       []string
+	}{
+		{
+			name:    "default rules on Ischemia",
+			hashKey: "secret",
+			record:  ischemiaRecord,
+			hashed:  []string{"numtransplante"},
+			dropped: []string{"nome", "IdOperador", "niveldepermissao"},
+		},
+		{
+			name:    "default rules on TransportSummary",
+			hashKey: "secret",
+			record:  transportRecord,
+			hashed:  []string{"numtransplante"},
+		},
+		{
+			name:   "hash without key drops",
+			record: transportRecord,
+			want:   `TransportSummary,deviceId=HP\ 01,deviceType=HealthPack,direction=event,origin=imt,orgao=rim idModal="M1",durationSeconds=600 1700000000000000000`,
+		},
+		{
+			name: "encrypt",
+			rules: []PrivacyRule{
+				{Measurement: "Ischemia", Field: "nome", Action: "encrypt"},
+				{Measurement: "Ischemia", Field: "IdOperador", Action: "drop"},
+				{Measurement: "*", Field: "numtransplante", Action: "encrypt"},
+			},
+			encryptionKey: encryptionKey,
+			record:        ischemiaRecord,
+			encrypted:     []string{"nome", "numtransplante"},
+			dropped:       []string{"IdOperador"},
+		},
+		{
+			name: "encrypt without key drops",
+			rules: []PrivacyRule{
+				{Measurement: "*", Field: "nome", Action: "encrypt"},
+				{Measurement: "*", Field: "IdOperador", Action: "encrypt"},
+				{Measurement: "*", Field: "numtransplante", Action: "encrypt"},
+			},
+			record:  ischemiaRecord,
+			dropped: []string{"nome", "IdOperador", "numtransplante"},
+		},
+		{
+			name: "record left without fields",
+			rules: []PrivacyRule{
+				{Measurement: "Ischemia", Field: "nome", Action: "drop"},
+			},
+			record: `Ischemia,deviceId=HP01 nome="Maria Silva" 1700000000000000000`,
+		},
+		{
+			name:    "record that does not parse",
+			hashKey: "secret",
+			record:  `Ischemia,deviceId=HP 01,numtransplante=TX-2024-001 nome="Maria Silva",IdOperador="op-77" 1700000000000000000`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupPrivacyTest(t, test.rules, test.hashKey, test.encryptionKey)
+
+			got := applyPrivacy(test.record)
+			for _, clear := range privacyClearText {
+				if strings.Contains(got, clear) {
+					t.Fatalf("%q left in clear text: %s", clear, got)
+				}
+			}
+			if test.want != "" && got != test.want {
+				t.Fatalf("got %s\nwant %s", got, test.want)
+			}
+			if len(test.hashed)+len(test.encrypted)+len(test.dropped) == 0 {
+				if test.want == "" && got != "" {
+					t.Fatalf("record not dropped: %s", got)
+				}
+				return
+			}
+
+			line, ok := parseLine(got)
+			if !ok {
+				t.Fatalf("output does not parse: %s", got)
+			}
+			for _, key := range test.dropped {
+				if _, ok := line.Tags[key]; ok {
+					t.Errorf("tag %s not dropped", key)
+				}
+				if _, ok := line.Fields[key]; ok {
+					t.Errorf("field %s not dropped", key)
+				}
+			}
+			for _, key := range test.hashed {
+				if want := `"` + privacyHash("TX-2024-001") + `"`; line.Fields[key] != want && line.Tags[key] != strings.Trim(want, `"`) {
+					t.Errorf("%s is not the hash: %s", key, got)
+				}
+			}
+			for _, key := range test.encrypted {
+				value, ok := line.Tags[key]
+				if !ok {
+					value = strings.Trim(line.Fields[key], `"`)
+				}
+				plain := privacyDecrypt(t, test.encryptionKey, value)
+				if !contains(privacyClearText, plain) {
+					t.Errorf("%s decrypts to %q", key, plain)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyPrivacyCountsUnparsedRecords(t *testing.T) {
+	setupPrivacyTest(t, nil, "secret", "")
+
+	before := privacyDropped.Value()
+	if got := applyPrivacy(`Ischemia not line protocol`); got != "" {
+		t.Fatalf("got %s", got)
+	}
+	if privacyDropped.Value() != before+1 {
+		t.Fatalf("privacyDroppedRecords not counted")
+	}
+	if got := applyPrivacy(""); got != "" || privacyDropped.Value() != before+1 {
+		t.Fatalf("empty message counted as dropped")
+	}
+}
+
+func TestApplyPrivacyPassesUncoveredRecords(t *testing.T) {
+	setupPrivacyTest(t, nil, "secret", "")
+
+	before := privacyDropped.Value()
+	for _, record := range []string{
+		// An empty field value
+		`lns_link_quality,deviceType=LNS,deviceId=0004a30b001c5f7a rssi=-97,gatewayId= 1700000000000000000`,
+		// More than 3 unquoted parts
+		`StatusNotification,deviceId=cp-01,deviceType=EVSE status=Available connector 1 1700000000000000000`,
+	} {
+		if got := applyPrivacy(record); got != record {
+			t.Errorf("got %s\nwant %s", got, record)
+		}
+	}
+	if privacyDropped.Value() != before {
+		t.Errorf("uncovered records counted as dropped")
+	}
+}
+
+func privacyDecrypt(t *testing.T, encodedKey string, value string) string {
+	t.Helper()
+	key, _ := base64.StdEncoding.DecodeString(encodedKey)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatalf("%q is not URL base64: %v", value, err)
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(plain)
+}
+
+func TestHealthPackIschemiaProtected(t *testing.T) {
+	setupPrivacyTest(t, nil, "secret", "")
+	t.Cleanup(func() {
+		pendingRecords = pendingRecords[:0]
+		ischemiaStates = make(map[string]*IschemiaState)
+		transports = make(map[string]*Transport)
+	})
+
+	// A deviceName with a space used to give a line that does not parse
+	message := `{"props": {"deviceName": "HP 01", "macAddress": "AA:BB:CC:DD:EE:FF", "deviceIp": "10.0.0.7"},
+		"date": "24:10:19 10:00:00",
+		"data": {"orgao": "rim", "numtransplante": "TX-2024-001", "nome": "Maria Silva", "IdOperador": "op-77",
+			"niveldepermissao": "3", "idModal": "M1", "tempo_restante_isquemia": "01:00", "tempo_total_isquemia": "00:10"}}`
+
+	record := parseHealthPack("SaoRafael", "Ischemia", "HealthPack", "0001", "up", "imt", message)
+	if _, ok := parseLine(record); !ok {
+		t.Fatalf("record does not parse: %s", record)
+	}
+	got := applyPrivacy(record)
+	if got == "" {
+		t.Fatalf("record dropped: %s", record)
+	}
+	for _, clear := range privacyClearText {
+		if strings.Contains(got, clear) {
+			t.Fatalf("%q left in clear text: %s", clear, got)
+		}
+	}
+	if !strings.Contains(got, `deviceId=HP\ 01`) {
+		t.Fatalf("deviceId not escaped: %s", got)
+	}
+}
+
+func TestPrivacyLogId(t *testing.T) {
+	setupPrivacyTest(t, nil, "", "")
+	if got := privacyLogId("TX-2024-001"); got != "[redacted]" {
+		t.Errorf("without a hash key got %q", got)
+	}
+
+	setupPrivacyTest(t, nil, "secret", "")
+	got := privacyLogId("TX-2024-001")
+	if len(got) != 12 || !strings.HasPrefix(privacyHash("TX-2024-001"), got) {
+		t.Errorf("with a hash key got %q", got)
+	}
+}
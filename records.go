@@ -0,0 +1,21 @@
+package main
+
+// Record is a line protocol record produced besides the one parsed from an MQTT message,
+// e.g. link quality or alerts. Topic overrides the Kafka topic of the gateway when set.
+type Record struct {
+	Topic string
+	Value string
+}
+
+// pendingRecords is filled while a message is parsed and flushed by the main loop after the
+// parsed message itself was produced. It is only touched from the main loop goroutine.
+var pendingRecords []Record
+
+func emitRecord(value string) {
+	pendingRecords = append(pendingRecords, Record{Value: value})
+}
+
+// emitRecordTo queues value for topic instead of the Kafka topic of the gateway.
+func emitRecordTo(topic string, value string) {
+	pendingRecords = append(pendingRecords, Record{Topic: topic, Value: value})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// AlertRule raises an alert when a decoded field crosses a threshold, e.g.
+// {"name": "tank-empty", "measurement": "WaterTankLevel", "field": "distance", "operator": ">", "threshold": 180, "hysteresis": 5, "rearm": "30m"}
+type AlertRule struct {
+	Name        string   `json:"name"`
+	Measurement string   `json:"measurement"`
+	DeviceId    string   `json:"device_id"` // every device of the measurement when empty
+	Field       string   `json:"field"`
+	Operator    string   `json:"operator"` // >, >=, <, <=, ==, != or outside
+	Threshold   float64  `json:"threshold"`
+	Min         float64  `json:"min"` // range of the outside operator
+	Max         float64  `json:"max"`
+	Hysteresis  float64  `json:"hysteresis"` // how far back the value must go for the rule to clear
+	Rearm       Duration `json:"rearm"`      // minimum time between two alerts of a device
+}
+
+// AlertRuleState is the state of a rule for one device.
+type AlertRuleState struct {
+	Active     bool
+	LastPlayed time.Time
+}
+
+// alertRuleStates is keyed by rule name/deviceId and only touched from the main loop goroutine.
+var alertRuleStates = make(map[string]*AlertRuleState)
+
+// evaluateAlertRules checks the fields of a parsed message against the alert rules and emits
+// an alert for every rule that fires.
+func evaluateAlertRules(message string, deviceType string, deviceId string, now time.Time) {
+	if len(schema.AlertRules) == 0 {
+		return
+	}
+
+	line, ok := parseLine(message)
+	if !ok {
+		return
+	}
+	if id, ok := line.Tags["deviceId"]; ok && id != "" {
+		deviceId = id
+	}
+
+	for i := range schema.AlertRules {
+		rule := &schema.AlertRules[i]
+		if rule.Measurement != line.Measurement || (rule.DeviceId != "" && rule.DeviceId != deviceId) {
+			continue
+		}
+		value, ok := fieldFloat(line.Fields[rule.Field])
+		if !ok {
+			continue
+		}
+
+		key := rule.Name + "/" + deviceId
+		state, ok := alertRuleStates[key]
+		if !ok {
+			state = &AlertRuleState{}
+			alertRuleStates[key] = state
+		}
+
+		if state.Active {
+			if rule.cleared(value) {
+				state.Active = false
+			}
+			continue
+		}
+
+		if !rule.triggered(value) || (!state.LastPlayed.IsZero() && now.Sub(state.LastPlayed) < rule.Rearm.Duration) {
+			continue
+		}
+
+		var alert Alert
+		alert.DeviceId = deviceId
+		alert.DeviceType = deviceType
+		alert.Etc = "gateway"
+		alert.Data = rule.Name
+		alert.Timestamp = line.Timestamp
+		if alert.Timestamp == 0 {
+			alert.Timestamp = now.UnixNano()
+		}
+		alert.Trigger = rule.String()
+		alert.TriggerAt = now.Format(time.RFC3339)
+		alert.TriggerType = "threshold"
+		if !state.LastPlayed.IsZero() {
+			alert.LastPlayed = state.LastPlayed.Format(time.RFC3339)
+		}
+		alert.ActionSensor = rule.Field
+		alert.CurrentValue = strconv.FormatFloat(value, 'f', -1, 64)
+
+		state.Active = true
+		state.LastPlayed = now
+		emitRecord(formatAlert(line.Measurement, deviceType, deviceId, alert.Etc, alert))
+	}
+}
+
+func (r *AlertRule) triggered(value float64) bool {
+	switch r.Operator {
+	case ">":
+		return value > r.Threshold
+	case ">=":
+		return value >= r.Threshold
+	case "<":
+		return value < r.Threshold
+	case "<=":
+		return value <= r.Threshold
+	case "==":
+		return value == r.Threshold
+	case "!=":
+		return value != r.Threshold
+	case "outside":
+		return value < r.Min || value > r.Max
+	}
+	return false
+}
+
+// cleared reports whether value went back past the threshold by the hysteresis.
+func (r *AlertRule) cleared(value float64) bool {
+	switch r.Operator {
+	case ">", ">=":
+		return value < r.Threshold-r.Hysteresis
+	case "<", "<=":
+		return value > r.Threshold+r.Hysteresis
+	case "outside":
+		return value >= r.Min+r.Hysteresis && value <= r.Max-r.Hysteresis
+	}
+	return !r.triggered(value)
+}
+
+func (r *AlertRule) String() string {
+	if r.Operator == "outside" {
+		return fmt.Sprintf("%s outside [%g, %g]", r.Field, r.Min, r.Max)
+	}
+	return fmt.Sprintf("%s %s %g", r.Field, r.Operator, r.Threshold)
+}
+
+// validateAlertRules reports the first rule that cannot be evaluated.
+func validateAlertRules(rules []AlertRule) error {
+	for _, rule := range rules {
+		if rule.Name == "" || rule.Measurement == "" || rule.Field == "" {
+			return fmt.Errorf("alert rule %q needs a name, measurement and field", rule.Name)
+		}
+		switch rule.Operator {
+		case ">", ">=", "<", "<=", "==", "!=":
+		case "outside":
+			if rule.Min > rule.Max {
+				return fmt.Errorf("alert rule %q has min greater than max", rule.Name)
+			}
+		default:
+			return fmt.Errorf("alert rule %q has unknown operator %q", rule.Name, rule.Operator)
+		}
+	}
+	return nil
+}
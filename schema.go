@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+	_ "time/tzdata" // the gateway image has no zoneinfo
+)
+
+// Schema is the device registry read from SCHEMA_FILE, see schema.json.
+type Schema struct {
+	Organizations []SchemaOrganization `json:"organizations"`
+	AlertRules    []AlertRule          `json:"alert_rules"`
+
+	BatteryCurves   map[string]BatteryCurve `json:"battery_curves"`
+	BatteryProfiles []BatteryProfile        `json:"battery_profiles"`
+
+	IschemiaThresholds   map[string]Duration            `json:"ischemia_thresholds"`   // by lowercase orgao, "*" for the others
+	TemperatureEnvelopes map[string]TemperatureEnvelope `json:"temperature_envelopes"` // by lowercase orgao, "*" for the others
+
+	PrivacyRules []PrivacyRule `json:"privacy_rules"`
+
+	Geofences []Geofence `json:"geofences"`
+
+	HealthPackCodes           map[string]map[string]string `json:"healthpack_codes"`            // names by Status field and code
+	HealthPackTransportStates []int64                      `json:"healthpack_transport_states"` // estadomaquina codes of a box carrying an organ
+	HealthPackAlarmKeys       []string                     `json:"healthpack_alarm_keys"`       // data keys of an Alarm uplink without an alarms object
+
+	JsonMappings []JsonMapping `json:"json_mappings"` // JSON device families decoded from configuration
+}
+
+type SchemaOrganization struct {
+	OrganizationName string              `json:"organization_name"`
+	TimeZone         string              `json:"time_zone"` // IANA name, e.g. "America/Sao_Paulo"
+	Applications     []SchemaApplication `json:"applications"`
+}
+
+type SchemaApplication struct {
+	ApplicationName string         `json:"application_name"`
+	Devices         []SchemaDevice `json:"devices"`
+}
+
+type SchemaDevice struct {
+	DeviceName        string   `json:"device_name"`
+	DeviceId          string   `json:"device_id"`
+	DeviceType        string   `json:"device_type"`
+	ReportingInterval Duration `json:"reporting_interval"` // e.g. "15m", learned from the uplinks when empty
+
+	Tank    *TankGeometry  `json:"tank"`    // WaterTankLevel
+	Counter *CounterConfig `json:"counter"` // Hydrometer, Sprinkler, EnergyMeter and WeatherStation counters
+
+	BatteryChemistry string `json:"battery_chemistry"` // overrides the chemistry of the battery profile
+	TimeZone         string `json:"time_zone"`         // overrides the time zone of the organization
+
+	OcppVersion string `json:"ocpp_version"` // EVSE, "1.6" or "2.0.1", unless given by the topic
+}
+
+// Duration is a time.Duration written as a string such as "90s" or "1h30m" in JSON.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if s == "" {
+		d.Duration = 0
+		return nil
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+var schema Schema
+
+func loadSchema(path string) (Schema, error) {
+	var s Schema
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := validateAlertRules(s.AlertRules); err != nil {
+		return s, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := validateBatteryCurves(s.BatteryCurves); err != nil {
+		return s, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := validateBatteryProfiles(s.BatteryProfiles); err != nil {
+		return s, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := validateTemperatureEnvelopes(s.TemperatureEnvelopes); err != nil {
+		return s, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := validateGeofences(s.Geofences); err != nil {
+		return s, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := validatePrivacyRules(s.PrivacyRules); err != nil {
+		return s, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := validateTimeZones(s); err != nil {
+		return s, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := validateHealthPackCodes(s); err != nil {
+		return s, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := validateOcppVersions(s); err != nil {
+		return s, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := validateJsonMappings(s.JsonMappings); err != nil {
+		return s, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// lookupDevice returns the registry entry of deviceId. The device type of the registry may be
+// the topic measurement (WaterTankLevel) or the topic device type (HealthPack), so every given
+// type is tried in order. It returns nil when the device is not registered.
+func lookupDevice(deviceId string, deviceTypes ...string) *SchemaDevice {
+	for _, deviceType := range deviceTypes {
+		for i := range schema.Organizations {
+			for j := range schema.Organizations[i].Applications {
+				devices := schema.Organizations[i].Applications[j].Devices
+				for k := range devices {
+					if devices[k].DeviceId == deviceId && devices[k].DeviceType == deviceType {
+						return &devices[k]
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// deviceOrganization returns the organization deviceId is registered in, or "" when it is not.
+func deviceOrganization(deviceId string, deviceTypes ...string) string {
+	for _, deviceType := range deviceTypes {
+		for _, organization := range schema.Organizations {
+			for _, application := range organization.Applications {
+				for _, device := range application.Devices {
+					if device.DeviceId == deviceId && device.DeviceType == deviceType {
+						return organization.OrganizationName
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// locations caches the loaded time zones by name.
+var locations = make(map[string]*time.Location)
+
+// deviceLocation returns the time zone of deviceId: the one of the device in the registry, else the
+// one of its organization, else fallback.
+func deviceLocation(organization string, fallback string, deviceId string, deviceTypes ...string) *time.Location {
+	name := fallback
+	for i := range schema.Organizations {
+		if schema.Organizations[i].OrganizationName == organization && schema.Organizations[i].TimeZone != "" {
+			name = schema.Organizations[i].TimeZone
+		}
+	}
+	if device := lookupDevice(deviceId, deviceTypes...); device != nil && device.TimeZone != "" {
+		name = device.TimeZone
+	}
+
+	location, ok := locations[name]
+	if !ok {
+		var err error
+		location, err = time.LoadLocation(name)
+		if err != nil {
+			fmt.Printf("\nUnknown time zone %s, using UTC", name)
+			location = time.UTC
+		}
+		locations[name] = location
+	}
+	return location
+}
+
+func validateTimeZones(s Schema) error {
+	for _, organization := range s.Organizations {
+		if _, err := time.LoadLocation(organization.TimeZone); err != nil {
+			return fmt.Errorf("organization %q: %w", organization.OrganizationName, err)
+		}
+		for _, application := range organization.Applications {
+			for _, device := range application.Devices {
+				if _, err := time.LoadLocation(device.TimeZone); err != nil {
+					return fmt.Errorf("device %q: %w", device.DeviceId, err)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChargingSession is an open transaction of a charger connector, from StartTransaction until
+// StopTransaction.
+type ChargingSession struct {
+	DeviceId      string  `json:"deviceId"`
+	DeviceType    string  `json:"deviceType"`
+	Origin        string  `json:"origin"`
+	ChargePointId string  `json:"chargePointId"`
+	ConnectorId   string  `json:"connectorId"`
+	TransactionId string  `json:"transactionId"`
+	IdTag         string  `json:"idTag"`
+	StartMeter    *int64  `json:"startMeter"` // Wh, nil until known
+	StartTime     int64   `json:"startTime"`  // as sent by the charger
+	Started       int64   `json:"started"`    // ns
+	LastSeen      int64   `json:"lastSeen"`   // ns
+	Samples       int     `json:"samples"`    // sampled values received during the session
+	MaxPower      float64 `json:"maxPower"`   // W
+	LastEnergy    float64 `json:"lastEnergy"` // Wh, last Energy.Active.Import.Register sample
+}
+
+// chargingSessions is keyed by chargePointId/connectorId and only touched from the main loop goroutine.
+var chargingSessions = make(map[string]*ChargingSession)
+
+var (
+	// chargingSessionFile keeps the open sessions across restarts when set
+	chargingSessionFile string
+	// Sessions without news for chargingSessionMaxAge are closed as orphans
+	chargingSessionMaxAge = 48 * time.Hour
+	// Samples are saved at most every chargingSessionSaveInterval, and by the liveness ticker
+	chargingSessionSaveInterval = time.Minute
+
+	chargingSessionsSaved time.Time
+	chargingSessionsDirty bool
+)
+
+// startChargingSession opens a session for a StartTransaction. A session still open on the
+// connector lost its StopTransaction and is closed as an orphan.
+func startChargingSession(evseUp EvseUp, start EvseStartTransaction, deviceType string, etc string) {
+	key := evseUp.ChargePointId + "/" + evseUp.ConnectorId
+
+	if session, ok := chargingSessions[key]; ok {
+		emitRecord(chargingSessionRecord(session, deviceType, etc, nil, evseUp.Timestamp))
+	}
+
+	chargingSessions[key] = &ChargingSession{
+		DeviceId:      evseUp.DeviceId,
+		DeviceType:    deviceType,
+		Origin:        etc,
+		ChargePointId: evseUp.ChargePointId,
+		ConnectorId:   evseUp.ConnectorId,
+		TransactionId: start.TransactionId.String(),
+		IdTag:         start.IdTag,
+		StartMeter:    start.StartMeter,
+		StartTime:     start.StartTime,
+		Started:       evseUp.Timestamp,
+		LastSeen:      evseUp.Timestamp,
+	}
+	saveChargingSessions()
+}
+
+// stopChargingSession closes the session of a StopTransaction and emits its ChargingSession
+// record. The session is found by connector, else by transactionId since StopTransaction does
+// not have to name the connector. Without a session, e.g. after the state was lost, an orphan
+// record with what the StopTransaction carries is emitted.
+func stopChargingSession(evseUp EvseUp, stop EvseStopTransaction, deviceType string, etc string) {
+	key := evseUp.ChargePointId + "/" + evseUp.ConnectorId
+	transactionId := stop.TransactionId.String()
+
+	session, ok := chargingSessions[key]
+	if !ok || (transactionId != "" && session.TransactionId != transactionId) {
+		session = chargingSessionOf(evseUp.ChargePointId, transactionId)
+		ok = session != nil
+		if ok {
+			key = session.ChargePointId + "/" + session.ConnectorId
+		}
+	}
+
+	if !ok {
+		fmt.Printf("\nStopTransaction %s of %s without an open session", transactionId, evseUp.ChargePointId)
+		orphan := &ChargingSession{
+			DeviceId:      evseUp.DeviceId,
+			ChargePointId: evseUp.ChargePointId,
+			ConnectorId:   evseUp.ConnectorId,
+			TransactionId: stop.TransactionId.String(),
+		}
+		emitRecord(chargingSessionRecord(orphan, deviceType, etc, &stop, evseUp.Timestamp))
+		return
+	}
+
+	emitRecord(chargingSessionRecord(session, deviceType, etc, &stop, evseUp.Timestamp))
+	delete(chargingSessions, key)
+	saveChargingSessions()
+}
+
+// addChargingSessionSamples adds the sampled values of a MeterValues message to the open
+// session of the connector, else to the one of transactionId.
+func addChargingSessionSamples(evseUp EvseUp, samples []EvseMeterValueSample, transactionId string) {
+	session, ok := chargingSessions[evseUp.ChargePointId+"/"+evseUp.ConnectorId]
+	if !ok {
+		session = chargingSessionOf(evseUp.ChargePointId, transactionId)
+	}
+	if session == nil {
+		return
+	}
+
+	for _, sample := range samples {
+		for _, sampledValue := range sample.SampledValue {
+			value, err := strconv.ParseFloat(strings.TrimSpace(sampledValue.Value), 64)
+			if err != nil {
+				continue
+			}
+			session.Samples++
+
+			if sampledValue.Unit == "kW" || sampledValue.Unit == "kWh" {
+				value *= 1000
+			}
+			switch ocppDefault(sampledValue.Measurand, evseUp.Measurand, "Energy.Active.Import.Register") {
+			case "Energy.Active.Import.Register":
+				if session.StartMeter == nil {
+					startMeter := int64(math.Round(value))
+					session.StartMeter = &startMeter
+				}
+				session.LastEnergy = value
+			case "Power.Active.Import":
+				// Phases are summed by the charger when phase is empty
+				if sampledValue.Phase == "" && value > session.MaxPower {
+					session.MaxPower = value
+				}
+			}
+		}
+	}
+	if evseUp.Timestamp > session.LastSeen {
+		session.LastSeen = evseUp.Timestamp
+	}
+
+	chargingSessionsDirty = true
+	if time.Since(chargingSessionsSaved) >= chargingSessionSaveInterval {
+		saveChargingSessions()
+	}
+}
+
+// chargingSessionOf returns the open session of transactionId on a charger, or nil.
+func chargingSessionOf(chargePointId string, transactionId string) *ChargingSession {
+	if transactionId == "" {
+		return nil
+	}
+	for _, session := range chargingSessions {
+		if session.ChargePointId == chargePointId && session.TransactionId == transactionId {
+			return session
+		}
+	}
+	return nil
+}
+
+// expireChargingSessions closes the sessions without news for chargingSessionMaxAge as orphans,
+// and saves the samples added since the last save.
+func expireChargingSessions(now time.Time) {
+	changed := false
+	for key, session := range chargingSessions {
+		if now.Sub(time.Unix(0, session.LastSeen)) < chargingSessionMaxAge {
+			continue
+		}
+		fmt.Printf("\nCharging session %s of %s expired", session.TransactionId, key)
+		emitRecord(chargingSessionRecord(session, session.DeviceType, session.Origin, nil, now.UnixNano()))
+		delete(chargingSessions, key)
+		changed = true
+	}
+	if changed || chargingSessionsDirty {
+		saveChargingSessions()
+	}
+}
+
+// chargingSessionRecord formats a session as
+// ChargingSession,deviceId=,deviceType=,chargePointId=,connectorId=,direction=event,origin= transactionId=,idTag=,startTime=,stopTime=,durationSeconds=,energy=,meterValueSamples=,maxPower=,orphan= timestamp
+// stop is nil for a session that never got its StopTransaction, and orphan is set when either end is missing.
+func chargingSessionRecord(session *ChargingSession, deviceType string, etc string, stop *EvseStopTransaction, timestamp int64) string {
+	var sb strings.Builder
+
+	started := session.Started != 0
+
+	sb.WriteString(`ChargingSession`)
+
+	// Tags
+	writeTag(&sb, "deviceId", session.DeviceId)
+	writeTag(&sb, "deviceType", deviceType)
+	writeTag(&sb, "chargePointId", session.ChargePointId)
+	writeTag(&sb, "connectorId", session.ConnectorId)
+	sb.WriteString(`,direction=event`)
+	writeTag(&sb, "origin", etc)
+
+	// Fields
+	sb.WriteString(` `)
+	sb.WriteString(`transactionId="`)
+	sb.WriteString(fieldStringEscaper.Replace(session.TransactionId))
+	sb.WriteString(`"`)
+	writeStringField(&sb, "idTag", session.IdTag)
+	if started {
+		sb.WriteString(`,startTime=`)
+		sb.WriteString(strconv.FormatInt(session.StartTime, 10))
+		if session.StartMeter != nil {
+			sb.WriteString(`,startMeter=`)
+			sb.WriteString(strconv.FormatInt(*session.StartMeter, 10))
+		}
+	}
+	if stop != nil {
+		sb.WriteString(`,stopTime=`)
+		sb.WriteString(strconv.FormatInt(stop.StopTime, 10))
+		if stop.MeterStop != nil {
+			sb.WriteString(`,meterStop=`)
+			sb.WriteString(strconv.FormatInt(*stop.MeterStop, 10))
+		}
+	}
+	if started {
+		sb.WriteString(`,durationSeconds=`)
+		sb.WriteString(strconv.FormatFloat(time.Duration(timestamp-session.Started).Seconds(), 'f', 0, 64))
+
+		// Energy delivered in Wh, up to the last sample when the stop or its meter is missing, and
+		// left out while the start meter is unknown
+		switch {
+		case session.StartMeter == nil:
+		case stop != nil && stop.MeterStop != nil && *stop.MeterStop >= *session.StartMeter:
+			sb.WriteString(`,energy=`)
+			sb.WriteString(strconv.FormatInt(*stop.MeterStop-*session.StartMeter, 10))
+		case session.LastEnergy > 0:
+			sb.WriteString(`,energy=`)
+			sb.WriteString(strconv.FormatFloat(session.LastEnergy-float64(*session.StartMeter), 'f', -1, 64))
+		}
+	}
+	sb.WriteString(`,meterValueSamples=`)
+	sb.WriteString(strconv.Itoa(session.Samples))
+	if session.MaxPower > 0 {
+		sb.WriteString(`,maxPower=`)
+		sb.WriteString(strconv.FormatFloat(session.MaxPower, 'f', -1, 64))
+	}
+	sb.WriteString(`,orphan=`)
+	sb.WriteString(strconv.FormatBool(!started || stop == nil))
+
+	// Timestamp_ns
+	sb.WriteString(` `)
+	sb.WriteString(strconv.FormatInt(timestamp, 10))
+
+	return sb.String()
+}
+
+// loadChargingSessions restores the sessions saved in chargingSessionFile.
+func loadChargingSessions() error {
+	if chargingSessionFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(chargingSessionFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &chargingSessions); err != nil {
+		return fmt.Errorf("parsing %s: %w", chargingSessionFile, err)
+	}
+	fmt.Printf("Restored %d open charging sessions\n", len(chargingSessions))
+	return nil
+}
+
+// saveChargingSessions writes the open sessions to chargingSessionFile, replacing it atomically.
+func saveChargingSessions() {
+	if chargingSessionFile == "" {
+		return
+	}
+	chargingSessionsSaved = time.Now()
+	chargingSessionsDirty = false
+
+	b, err := json.Marshal(chargingSessions)
+	if err != nil {
+		fmt.Printf("\nSaving charging sessions failed: %v", err)
+		return
+	}
+	tmp := filepath.Join(filepath.Dir(chargingSessionFile), "."+filepath.Base(chargingSessionFile)+".tmp")
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		fmt.Printf("\nSaving charging sessions failed: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, chargingSessionFile); err != nil {
+		fmt.Printf("\nSaving charging sessions failed: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChargingSessionStartMeterFromFirstSample(t *testing.T) {
+	t.Cleanup(func() {
+		pendingRecords = pendingRecords[:0]
+		chargingSessions = make(map[string]*ChargingSession)
+	})
+	pendingRecords = pendingRecords[:0]
+	chargingSessions = make(map[string]*ChargingSession)
+
+	envelope := `"deviceId": "CP01", "chargePointId": "CP01", "timestamp": "2024-05-01T10:00:00Z"`
+	messages := []struct {
+		measurement string
+		message     string
+	}{
+		{"TransactionEvent", `{` + envelope + `, "eventType": "Started", "evse": {"id": 1}, "transactionInfo": {"transactionId": "T1"}}`},
+		{"TransactionEvent", `{` + envelope + `, "eventType": "Updated", "transactionInfo": {"transactionId": "T1"}, "meterValue": [{"sampledValue": [{"value": 15000}]}]}`},
+		{"TransactionEvent", `{` + envelope + `, "eventType": "Ended", "transactionInfo": {"transactionId": "T1"}, "meterValue": [{"sampledValue": [{"value": 15235}]}]}`},
+	}
+	for _, m := range messages {
+		if record := parseEvse("IMT", m.measurement, "EVSE", "CP01", "up", "ocpp201", m.message); strings.Contains(record, "startMeter=0") {
+			t.Fatalf("unknown start meter written as 0: %s", record)
+		}
+	}
+
+	var sessions []string
+	for _, pending := range pendingRecords {
+		if strings.HasPrefix(pending.Value, "ChargingSession,") {
+			sessions = append(sessions, pending.Value)
+		}
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("want one ChargingSession record, got %q", sessions)
+	}
+	record := sessions[0]
+	for _, want := range []string{",startMeter=15000,", ",meterStop=15235,", ",energy=235,"} {
+		if !strings.Contains(record, want) {
+			t.Errorf("%s not in %s", want, record)
+		}
+	}
+}
+
+func TestChargingSessionUnknownStartMeter(t *testing.T) {
+	session := &ChargingSession{ChargePointId: "CP01", ConnectorId: "1", TransactionId: "T1", Started: 1, LastEnergy: 15235}
+	meterStop := int64(15235)
+	stop := &EvseStopTransaction{TransactionId: "T1", MeterStop: &meterStop}
+
+	record := chargingSessionRecord(session, "EVSE", "ocpp201", stop, 2)
+	if strings.Contains(record, "startMeter=") || strings.Contains(record, "energy=") {
+		t.Fatalf("energy without a start meter in %s", record)
+	}
+}
+
+func TestChargingSessionUnknownMeterStop(t *testing.T) {
+	t.Cleanup(func() {
+		pendingRecords = pendingRecords[:0]
+		chargingSessions = make(map[string]*ChargingSession)
+	})
+	pendingRecords = pendingRecords[:0]
+	chargingSessions = make(map[string]*ChargingSession)
+
+	envelope := `"deviceId": "CP01", "chargePointId": "CP01", "timestamp": "2024-05-01T10:00:00Z"`
+	parseEvse("IMT", "TransactionEvent", "EVSE", "CP01", "up", "ocpp201", `{`+envelope+`, "eventType": "Started", "evse": {"id": 1}, "transactionInfo": {"transactionId": "T1"}, "meterValue": [{"sampledValue": [{"value": 15000}]}]}`)
+	parseEvse("IMT", "TransactionEvent", "EVSE", "CP01", "up", "ocpp201", `{`+envelope+`, "eventType": "Updated", "transactionInfo": {"transactionId": "T1"}, "meterValue": [{"sampledValue": [{"value": 15100}]}]}`)
+	record := parseEvse("IMT", "TransactionEvent", "EVSE", "CP01", "up", "ocpp201", `{`+envelope+`, "eventType": "Ended", "transactionInfo": {"transactionId": "T1", "stoppedReason": "Local"}}`)
+	if !strings.HasPrefix(record, "StopTransaction,") || strings.Contains(record, "meterStop=") {
+		t.Fatalf("want a StopTransaction without meterStop, got %s", record)
+	}
+
+	var sessions []string
+	for _, pending := range pendingRecords {
+		if strings.HasPrefix(pending.Value, "ChargingSession,") {
+			sessions = append(sessions, pending.Value)
+		}
+	}
+	if len(sessions) != 1 || strings.Contains(sessions[0], "meterStop=") || !strings.Contains(sessions[0], ",energy=100,") {
+		t.Fatalf("want one session with the energy up to the last sample, got %q", sessions)
+	}
+}
+
+func TestEvseMeterValuesWithoutSamples(t *testing.T) {
+	tests := []struct {
+		name    string
+		etc     string
+		message string
+		want    string
+	}{
+		{"Updated without meter values", "ocpp201", `{"deviceId": "CP01", "chargePointId": "CP01", "timestamp": "2024-05-01T10:00:00Z", "eventType": "Updated", "evse": {"id": 1}, "transactionInfo": {"transactionId": "T1"}}`, ""},
+		{"MeterValues without samples", "ocpp16", `{"deviceId": "CP01", "chargePointId": "CP01", "connectorId": "1", "timestamp": 1}`, ""},
+		{"MeterValues with forwardEnergy", "ocpp16", `{"deviceId": "CP01", "chargePointId": "CP01", "connectorId": "1", "timestamp": 1, "forwardEnergy": 1500}`, " forwardEnergy=1.5 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			measurement := "MeterValues"
+			if tt.etc == "ocpp201" {
+				measurement = "TransactionEvent"
+			}
+			got := parseEvse("IMT", measurement, "EVSE", "CP01", "up", tt.etc, tt.message)
+			if tt.want == "" && got != "" || !strings.HasSuffix(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChargingSessionSamplesSaved(t *testing.T) {
+	chargingSessionFile = filepath.Join(t.TempDir(), "sessions.json")
+	t.Cleanup(func() {
+		chargingSessionFile = ""
+		chargingSessions = make(map[string]*ChargingSession)
+		pendingRecords = pendingRecords[:0]
+	})
+	chargingSessions = make(map[string]*ChargingSession)
+
+	now := time.Now()
+	evseUp := EvseUp{DeviceId: "CP01", ChargePointId: "CP01", ConnectorId: "1", Timestamp: now.UnixNano()}
+	startMeter := int64(1000)
+	startChargingSession(evseUp, EvseStartTransaction{TransactionId: "7", StartMeter: &startMeter}, "EVSE", "ocpp16")
+
+	samples := []EvseMeterValueSample{{SampledValue: []EvseSampledValue{{Value: "1500"}}}}
+	saved := func() *ChargingSession {
+		chargingSessions = make(map[string]*ChargingSession)
+		if err := loadChargingSessions(); err != nil {
+			t.Fatal(err)
+		}
+		return chargingSessions["CP01/1"]
+	}
+
+	// Right after the start the save is throttled, the liveness tick catches up
+	addChargingSessionSamples(evseUp, samples, "7")
+	expireChargingSessions(now)
+	if session := saved(); session == nil || session.LastEnergy != 1500 || session.Samples != 1 {
+		t.Fatalf("samples not saved by the tick: %+v", session)
+	}
+
+	chargingSessionsSaved = time.Time{}
+	samples[0].SampledValue[0].Value = "2500"
+	addChargingSessionSamples(evseUp, samples, "7")
+	if session := saved(); session == nil || session.LastEnergy != 2500 || session.Samples != 2 {
+		t.Fatalf("samples not saved: %+v", session)
+	}
+}
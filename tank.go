@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// TankGeometry describes the tank of a WaterTankLevel device. Lengths are in Unit, the unit of
+// the distance reported by the ultrasonic sensor.
+type TankGeometry struct {
+	Shape        string  `json:"shape"`         // cylinder (vertical) or rectangular
+	Height       float64 `json:"height"`        // from the bottom to the full level
+	SensorOffset float64 `json:"sensor_offset"` // distance measured when the tank is full
+	Diameter     float64 `json:"diameter"`      // cylinder
+	Length       float64 `json:"length"`        // rectangular
+	Width        float64 `json:"width"`         // rectangular
+	Unit         string  `json:"unit"`          // mm, cm (default) or m
+}
+
+// tankLevel returns the water height, the level as a percentage of the tank height and the
+// volume in liters for a distance read by the sensor.
+func tankLevel(tank *TankGeometry, distance float64) (levelHeight float64, levelPercent float64, volumeLiters float64) {
+	levelHeight = tank.Height - (distance - tank.SensorOffset)
+	levelHeight = math.Max(0, math.Min(tank.Height, levelHeight))
+
+	if tank.Height > 0 {
+		levelPercent = levelHeight / tank.Height * 100
+	}
+
+	var volume float64
+	switch tank.Shape {
+	case "rectangular":
+		volume = tank.Length * tank.Width * levelHeight
+	default:
+		volume = math.Pi * math.Pow(tank.Diameter/2, 2) * levelHeight
+	}
+
+	switch tank.Unit {
+	case "mm":
+		volumeLiters = volume / 1000000
+	case "m":
+		volumeLiters = volume * 1000
+	default:
+		volumeLiters = volume / 1000
+	}
+
+	return roundFloat(levelHeight, 2), roundFloat(levelPercent, 1), roundFloat(volumeLiters, 1)
+}
+
+// waterTankLevelFields formats the derived level fields of a WaterTankLevel device, empty when
+// the device has no tank geometry in the schema.
+func waterTankLevelFields(deviceId string, distance uint64) string {
+	var sb strings.Builder
+
+	device := lookupDevice(deviceId, "WaterTankLevel")
+	if device == nil || device.Tank == nil {
+		return ""
+	}
+
+	levelHeight, levelPercent, volumeLiters := tankLevel(device.Tank, float64(distance))
+
+	sb.WriteString(`,levelHeight=`)
+	sb.WriteString(strconv.FormatFloat(levelHeight, 'f', -1, 64))
+	sb.WriteString(`,levelPercent=`)
+	sb.WriteString(strconv.FormatFloat(levelPercent, 'f', -1, 64))
+	sb.WriteString(`,volumeLiters=`)
+	sb.WriteString(strconv.FormatFloat(volumeLiters, 'f', -1, 64))
+
+	return sb.String()
+}
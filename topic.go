@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultTopicLayout is the topic structure published by the network servers and devices:
+// OpenDataTelemetry/IMT/LNS/MEASUREMENT/DEVICE_ID/up/imt
+const defaultTopicLayout = "OpenDataTelemetry/{organization}/{deviceType}/{measurement}/{deviceId}/{direction}/{etc}"
+
+// TopicLayout maps the segments of an MQTT topic to named placeholders, e.g.
+// "debug/OpenDataTelemetry/{organization}/{deviceType}/{measurement}/{deviceId}/{direction}/{etc}".
+type TopicLayout struct {
+	Segments []string
+}
+
+type Topic struct {
+	Organization string
+	DeviceType   string
+	Measurement  string
+	DeviceId     string
+	Direction    string
+	Etc          string
+}
+
+type Subscription struct {
+	Filter string
+	Qos    byte
+}
+
+func newTopicLayout(layout string) (TopicLayout, error) {
+	var topicLayout TopicLayout
+	topicLayout.Segments = strings.Split(layout, "/")
+
+	for _, name := range []string{"organization", "deviceType", "measurement", "deviceId", "direction", "etc"} {
+		if topicLayout.index(name) < 0 {
+			return topicLayout, fmt.Errorf("topic layout %q has no {%s} segment", layout, name)
+		}
+	}
+	return topicLayout, nil
+}
+
+func (l TopicLayout) index(name string) int {
+	for i, segment := range l.Segments {
+		if segment == "{"+name+"}" {
+			return i
+		}
+	}
+	return -1
+}
+
+// Filter returns the subscription filter matching every topic of the layout.
+func (l TopicLayout) Filter() string {
+	segments := make([]string, len(l.Segments))
+	for i, segment := range l.Segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			segments[i] = "+"
+		} else {
+			segments[i] = segment
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// Parse splits topic according to the layout. It returns false when the number of segments
+// or any literal segment does not match.
+func (l TopicLayout) Parse(topic string) (Topic, bool) {
+	var t Topic
+
+	s := strings.Split(topic, "/")
+	if len(s) != len(l.Segments) {
+		return t, false
+	}
+	for i, segment := range l.Segments {
+		if !strings.HasPrefix(segment, "{") && s[i] != segment {
+			return t, false
+		}
+	}
+
+	t.Organization = s[l.index("organization")]
+	t.DeviceType = s[l.index("deviceType")]
+	t.Measurement = s[l.index("measurement")]
+	t.DeviceId = s[l.index("deviceId")]
+	t.Direction = s[l.index("direction")]
+	t.Etc = s[l.index("etc")]
+	return t, true
+}
+
+// parseSubscriptions parses a comma separated list of "filter[:qos]" entries, e.g.
+// "$share/gateway/OpenDataTelemetry/IMT/+/+/+/+/+:1,OpenDataTelemetry/SaoRafael/#:0".
+// Filters without an explicit QoS use defaultQos. When shareGroup is set, filters that are
+// not already shared are prefixed with $share/{shareGroup}/.
+func parseSubscriptions(spec string, defaultQos byte, shareGroup string) ([]Subscription, error) {
+	var subscriptions []Subscription
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		subscription := Subscription{Filter: entry, Qos: defaultQos}
+		if i := strings.LastIndex(entry, ":"); i >= 0 {
+			qos, err := strconv.ParseUint(entry[i+1:], 10, 8)
+			if err != nil || qos > 2 {
+				return nil, fmt.Errorf("invalid QoS in subscription %q", entry)
+			}
+			subscription.Filter = entry[:i]
+			subscription.Qos = byte(qos)
+		}
+
+		if shareGroup != "" && !strings.HasPrefix(subscription.Filter, "$share/") {
+			subscription.Filter = "$share/" + shareGroup + "/" + subscription.Filter
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	if len(subscriptions) == 0 {
+		return nil, fmt.Errorf("no MQTT subscriptions configured")
+	}
+	return subscriptions, nil
+}